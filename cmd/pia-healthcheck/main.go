@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/jdelkins/pia-tools/internal/health"
+	"github.com/jdelkins/pia-tools/internal/hook"
+	"github.com/jdelkins/pia-tools/internal/pia"
+	"github.com/jdelkins/pia-tools/internal/sdnotify"
+)
+
+type CLI struct {
+	IfName   string `short:"i" aliases:"ifname" default:"pia" help:"Name of WireGuard interface, used to determine cache filename."`
+	CacheDir string `short:"c" aliases:"cachedir" default:"/var/cache/pia" help:"Directory in which the tunnel's cache file is stored."`
+
+	MaxHandshakeAge time.Duration `default:"3m" help:"Fail if the last WireGuard handshake was longer ago than this."`
+	PingCount       int           `default:"3" help:"Number of pings to send to each of the server's virtual IP and a DNS server."`
+	PingTimeout     time.Duration `default:"5s" help:"Give up waiting for ping replies after this long."`
+	MaxLoss         float64       `default:"50" help:"Fail if more than this percentage of pings go unanswered."`
+	Privileged      bool          `help:"Send raw ICMP pings (requires CAP_NET_RAW) rather than unprivileged ones (requires net.ipv4.ping_group_range to include the user's group)."`
+
+	Interval  time.Duration `default:"10s" help:"Time between checks."`
+	Failures  int           `default:"3" help:"Number of consecutive failed checks after which the tunnel is unhealthy."`
+	Watch     bool          `help:"Keep checking, rather than exiting once the tunnel is found healthy. Under a Type=notify unit, pings the systemd watchdog while the tunnel is healthy."`
+	OnFailure []string      `name:"on-failure" sep:"none" placeholder:"COMMAND" help:"Run COMMAND with sh -c when the tunnel is unhealthy, eg to reset it. PIA_INTERFACE, PIA_REGION, PIA_SERVER_IP and PIA_SERVER_VIP, among others, are set in its environment. May be repeated."`
+}
+
+func (cli *CLI) thresholds() health.Thresholds {
+	return health.Thresholds{
+		MaxHandshakeAge: cli.MaxHandshakeAge,
+		PingCount:       cli.PingCount,
+		PingTimeout:     cli.PingTimeout,
+		MaxLoss:         cli.MaxLoss,
+		Privileged:      cli.Privileged,
+	}
+}
+
+// Run checks the tunnel every --interval until it is healthy, or, with
+// --watch, until interrupted. The cache is re-read for each check so that a
+// reset tunnel is picked up.
+func (cli *CLI) Run(ctx context.Context) error {
+	failures := 0
+	// the tunnel as last read, for the --on-failure environment
+	tun := &pia.Tunnel{Interface: cli.IfName}
+	if cli.Watch {
+		sdnotify.Notify(sdnotify.Ready)
+	}
+	for {
+		t, err := pia.ReadCache(cli.CacheDir, cli.IfName)
+		if err != nil {
+			err = fmt.Errorf("Could not read cache: %w", err)
+		} else {
+			tun = t
+			err = health.Check(ctx, tun, cli.thresholds())
+		}
+		if ctx.Err() != nil {
+			return cli.stop(ctx)
+		}
+
+		if err == nil {
+			if !cli.Watch {
+				fmt.Printf("Tunnel %s is healthy\n", cli.IfName)
+				return nil
+			}
+			if failures > 0 {
+				fmt.Printf("Tunnel %s has recovered\n", cli.IfName)
+			}
+			failures = 0
+			sdnotify.Status(fmt.Sprintf("Tunnel %s to %s is healthy", cli.IfName, tun.ServerIp))
+		} else {
+			failures++
+			fmt.Fprintf(os.Stderr, "Warning: %v (%d of %d)\n", err, failures, cli.Failures)
+			sdnotify.Status(fmt.Sprintf("Check %d of %d failed: %v", failures, cli.Failures, err))
+			if failures >= cli.Failures {
+				cli.fire(ctx, tun)
+				if !cli.Watch || len(cli.OnFailure) == 0 {
+					return fmt.Errorf("Tunnel %s is unhealthy: %w", cli.IfName, err)
+				}
+				failures = 0
+			}
+		}
+		// Keep the watchdog fed until the tunnel is declared unhealthy, so
+		// that a hung check is caught too.
+		if cli.Watch {
+			sdnotify.Notify(sdnotify.Watchdog)
+		}
+
+		select {
+		case <-ctx.Done():
+			return cli.stop(ctx)
+		case <-time.After(cli.Interval):
+		}
+	}
+}
+
+func (cli *CLI) stop(ctx context.Context) error {
+	if cli.Watch {
+		sdnotify.Notify(sdnotify.Stopping)
+		return nil
+	}
+	return ctx.Err()
+}
+
+// fire runs the --on-failure commands.
+func (cli *CLI) fire(ctx context.Context, tun *pia.Tunnel) {
+	for _, c := range cli.OnFailure {
+		h := hook.Command(c)
+		if err := h.Fire(ctx, hook.NewEvent(tun, 0)); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s failed: %v\n", h.Name(), err)
+		}
+	}
+}
+
+func main() {
+	var cli CLI
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	kctx := kong.Parse(&cli,
+		kong.Name("pia-healthcheck"),
+		kong.BindTo(ctx, (*context.Context)(nil)),
+	)
+	err := kctx.Run()
+	kctx.FatalIfErrorf(err)
+}
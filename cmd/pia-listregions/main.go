@@ -1,38 +1,158 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
 	"text/tabwriter"
+	"time"
 
+	"github.com/alecthomas/kong"
+	"github.com/jdelkins/pia-tools/internal/flags"
 	"github.com/jdelkins/pia-tools/internal/pia"
 )
 
+type CLI struct {
+	Timeout time.Duration `short:"t" default:"30s" help:"Give up on any single request to PIA after this long."`
+	Output  string        `short:"o" enum:"table,json,csv,yaml" default:"table" help:"Output format: 'table' for people; 'json', 'csv' or 'yaml' for programs, with every server and the ping time in milliseconds."`
+	Sort    string        `enum:"ping,name" default:"ping" help:"Sort regions by 'ping' time (fastest first) or by 'name'."`
+	Stream  bool          `help:"Print each region as soon as it has been probed, rather than sorting them once all have been. Only for table and csv output."`
+
+	InsecureServerlist bool          `help:"Do not verify the signature of PIA's serverlist."`
+	CacheDir           string        `short:"c" aliases:"cachedir" help:"Directory in which to cache the serverlist, eg /var/cache/pia (default: no cache)."`
+	ServerlistMaxAge   time.Duration `default:"1h" help:"With --cache-dir, use the cached serverlist without revalidating it if it is younger than this."`
+
+	flags.Filter       `embed:""`
+	flags.ProbeOptions `embed:""`
+}
+
 func main() {
-	regions, err := pia.RegionsWithPingTime()
+	var cli CLI
+	kong.Parse(&cli,
+		kong.Name("pia-listregions"),
+		kong.Vars{"pf_only": "false"},
+	)
+	pia.DefaultClient.Timeout = cli.Timeout
+	pia.DefaultClient.InsecureServerlist = cli.InsecureServerlist
+	pia.DefaultClient.ServerlistCacheDir = cli.CacheDir
+	pia.DefaultClient.ServerlistMaxAge = cli.ServerlistMaxAge
+	cli.ProbeOptions.Options().Configure(pia.DefaultClient)
+	if cli.Stream && cli.Output != "table" && cli.Output != "csv" {
+		log.Fatalf("--stream only works with --output table or csv")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	regions, age, err := pia.DefaultClient.RegionsWithAge(ctx)
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	// With a cache, say how old the serverlist is under the table.
+	footer := ""
+	if cli.CacheDir != "" {
+		footer = serverlistNote(age)
+	}
+	// Spare the probes for regions that would be filtered out anyway.
+	filter := cli.Filter.Options()
+	static := filter
+	static.MaxPing = 0
+	regions = static.Apply(regions)
 
-	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", "ID",             "NAME",                    "PING",      "WG?", "PF?")
-	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", "==============", "=======================", "=========", "===", "===")
-	for i := range regions {
-		r := &regions[i]
-		wg := ""
-		if r.HasWg() {
-			wg = " ✓"
+	var results []pia.ProbeResult
+	if cli.Stream {
+		var w rowWriter = newTableStream(os.Stdout, footer)
+		if cli.Output == "csv" {
+			w = newCSVStream(os.Stdout, age)
 		}
-		pf := ""
-		if r.PortForward {
-			pf = " ✓"
+		for res := range pia.DefaultClient.ProbeRegions(ctx, regions) {
+			if filter.Match(res.Region) {
+				w.Row(res)
+			}
 		}
-		if r.PingTime == 0 {
-			fmt.Fprintf(w, "%s\t%s\tN/A\t%s\t%s\n", r.Id, r.Name, wg, pf)
+		err = w.Close()
+	} else {
+		for res := range pia.DefaultClient.ProbeRegions(ctx, regions) {
+			if filter.Match(res.Region) {
+				results = append(results, res)
+			}
+		}
+		if cli.Sort == "name" {
+			slices.SortStableFunc(results, func(a, b pia.ProbeResult) int {
+				return strings.Compare(a.Region.Name, b.Region.Name)
+			})
 		} else {
-			fmt.Fprintf(w, "%s\t%s\t%d ms\t%s\t%s\n", r.Id, r.Name, r.PingTime.Milliseconds(), wg, pf)
+			slices.SortStableFunc(results, func(a, b pia.ProbeResult) int {
+				return pia.ComparePingTime(*a.Region, *b.Region)
+			})
+		}
+		switch cli.Output {
+		case "json":
+			err = writeJSON(os.Stdout, results, age)
+		case "csv":
+			err = writeCSV(os.Stdout, results, age)
+		case "yaml":
+			err = writeYAML(os.Stdout, results, age)
+		default:
+			writeTable(results, footer)
 		}
 	}
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if ctx.Err() != nil {
+		os.Exit(1)
+	}
+}
+
+func writeTable(results []pia.ProbeResult, footer string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", "ID",             "NAME",                    "PING",      "LOSS", "WG?", "PF?", "NOTE")
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", "==============", "=======================", "=========", "====", "===", "===", "====")
+	for _, res := range results {
+		fmt.Fprintln(w, strings.Join(tableRow(res), "\t"))
+	}
 	w.Flush()
+	if footer != "" {
+		fmt.Printf("\n%s\n", footer)
+	}
+}
+
+// serverlistNote says how old the serverlist is.
+func serverlistNote(age time.Duration) string {
+	if age == 0 {
+		return "Serverlist fetched just now"
+	}
+	return fmt.Sprintf("Serverlist cached %v ago", age.Round(time.Second))
+}
+
+// tableRow returns the cells of res's row in the table.
+func tableRow(res pia.ProbeResult) []string {
+	r := res.Region
+	wg := ""
+	if r.HasWg() {
+		wg = " ✓"
+	}
+	pf := ""
+	if r.PortForward {
+		pf = " ✓"
+	}
+	name := r.Name
+	if r.Offline {
+		name += " (offline)"
+	}
+	ping, loss, note := "N/A", "N/A", ""
+	if r.PingTime != 0 {
+		ping = fmt.Sprintf("%d ms", r.PingTime.Milliseconds())
+		loss = fmt.Sprintf("%.0f%%", r.PacketLoss)
+	}
+	if res.Err != nil {
+		note = res.Err.Error()
+	}
+	return []string{r.Id, name, ping, loss, wg, pf, note}
 }
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jdelkins/pia-tools/internal/pia"
+	"gopkg.in/yaml.v3"
+)
+
+// record is how a region is presented in machine-readable output.
+type record struct {
+	Id            string                  `json:"id" yaml:"id"`
+	Name          string                  `json:"name" yaml:"name"`
+	Country       string                  `json:"country" yaml:"country"`
+	Dns           string                  `json:"dns" yaml:"dns"`
+	PortForward   bool                    `json:"port_forward" yaml:"port_forward"`
+	Geo           bool                    `json:"geo" yaml:"geo"`
+	Offline       bool                    `json:"offline" yaml:"offline"`
+	AutoRegion    bool                    `json:"auto_region" yaml:"auto_region"`
+	PingMs        *int64                  `json:"ping_ms" yaml:"ping_ms"`                 // nil if unreachable
+	PacketLoss    float64                 `json:"packet_loss" yaml:"packet_loss"`         // percent
+	Error         string                  `json:"error,omitempty" yaml:"error,omitempty"` // why it is unreachable
+	Servers       map[string][]pia.Server `json:"servers" yaml:"servers"`
+	ServerlistAge int64                   `json:"serverlist_age_s" yaml:"serverlist_age_s"` // seconds; 0 if fetched just now
+}
+
+func newRecord(res pia.ProbeResult, age time.Duration) record {
+	r := res.Region
+	rec := record{
+		Id:            r.Id,
+		Name:          r.Name,
+		Country:       r.Country,
+		Dns:           r.Dns,
+		PortForward:   r.PortForward,
+		Geo:           r.Geo,
+		Offline:       r.Offline,
+		AutoRegion:    r.AutoRegion,
+		PacketLoss:    r.PacketLoss,
+		Servers:       r.Servers,
+		ServerlistAge: int64(age.Round(time.Second).Seconds()),
+	}
+	if r.PingTime != 0 {
+		ms := r.PingTime.Milliseconds()
+		rec.PingMs = &ms
+	}
+	if res.Err != nil {
+		rec.Error = res.Err.Error()
+	}
+	return rec
+}
+
+func records(results []pia.ProbeResult, age time.Duration) []record {
+	out := make([]record, len(results))
+	for i, res := range results {
+		out[i] = newRecord(res, age)
+	}
+	return out
+}
+
+func writeJSON(w io.Writer, results []pia.ProbeResult, age time.Duration) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(records(results, age))
+}
+
+func writeYAML(w io.Writer, results []pia.ProbeResult, age time.Duration) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(records(results, age)); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// writeCSV writes one row per server, repeating the region's fields, so that
+// each row is self-contained. A region without servers gets a single row with
+// the server columns empty.
+func writeCSV(w io.Writer, results []pia.ProbeResult, age time.Duration) error {
+	cw := newCSVStream(w, age)
+	for _, res := range results {
+		cw.Row(res)
+	}
+	return cw.Close()
+}
+
+// rowWriter prints regions one at a time, as they are probed.
+type rowWriter interface {
+	Row(res pia.ProbeResult)
+	Close() error
+}
+
+// csvStream writes the CSV of writeCSV, flushing it after each region.
+type csvStream struct {
+	cw  *csv.Writer
+	age time.Duration
+}
+
+func newCSVStream(w io.Writer, age time.Duration) *csvStream {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "name", "country", "dns", "port_forward", "geo", "offline", "auto_region", "ping_ms", "packet_loss", "error", "serverlist_age_s", "server_type", "server_ip", "server_cn", "server_van"})
+	return &csvStream{cw, age}
+}
+
+func (s *csvStream) Row(res pia.ProbeResult) {
+	r := newRecord(res, s.age)
+	ping := ""
+	if r.PingMs != nil {
+		ping = strconv.FormatInt(*r.PingMs, 10)
+	}
+	region := []string{r.Id, r.Name, r.Country, r.Dns, strconv.FormatBool(r.PortForward), strconv.FormatBool(r.Geo), strconv.FormatBool(r.Offline), strconv.FormatBool(r.AutoRegion), ping, strconv.FormatFloat(r.PacketLoss, 'f', -1, 64), r.Error, strconv.FormatInt(r.ServerlistAge, 10)}
+
+	types := make([]string, 0, len(r.Servers))
+	for typ := range r.Servers {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	rows := 0
+	for _, typ := range types {
+		for _, srv := range r.Servers[typ] {
+			s.cw.Write(append(region, typ, srv.Ip, srv.Cn, strconv.FormatBool(srv.Van)))
+			rows++
+		}
+	}
+	if rows == 0 {
+		s.cw.Write(append(region, "", "", "", ""))
+	}
+	s.cw.Flush()
+}
+
+func (s *csvStream) Close() error {
+	s.cw.Flush()
+	return s.cw.Error()
+}
+
+// tableStream writes the table of writeTable, a row at a time. Since the
+// rows to come are unknown, the columns have fixed widths, those of the
+// header's underlines, rather than fitting their contents.
+type tableStream struct {
+	w      io.Writer
+	footer string
+}
+
+var streamHeader = [][]string{
+	{"ID", "NAME", "PING", "LOSS", "WG?", "PF?", "NOTE"},
+	{"==============", "=======================", "=========", "====", "===", "===", "===="},
+}
+
+func newTableStream(w io.Writer, footer string) *tableStream {
+	s := &tableStream{w, footer}
+	for _, row := range streamHeader {
+		s.write(row)
+	}
+	return s
+}
+
+func (s *tableStream) write(cells []string) {
+	var b strings.Builder
+	for i, cell := range cells {
+		if i == len(cells)-1 {
+			b.WriteString(cell)
+			break
+		}
+		fmt.Fprintf(&b, "%-*s  ", len(streamHeader[1][i]), cell)
+	}
+	fmt.Fprintln(s.w, strings.TrimRight(b.String(), " "))
+}
+
+func (s *tableStream) Row(res pia.ProbeResult) {
+	s.write(tableRow(res))
+}
+
+func (s *tableStream) Close() error {
+	if s.footer != "" {
+		fmt.Fprintf(s.w, "\n%s\n", s.footer)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jdelkins/pia-tools/internal/hook"
+	"github.com/jdelkins/pia-tools/internal/nft"
+	"github.com/jdelkins/pia-tools/internal/notify"
+	"github.com/jdelkins/pia-tools/internal/pia"
+	"github.com/jdelkins/pia-tools/internal/sdnotify"
+)
+
+type DaemonCmd struct {
+	Interval time.Duration `default:"15m" help:"How often to refresh the port binding."`
+	Retry    time.Duration `default:"1m" help:"How soon to try again after a failed refresh."`
+	Renew    time.Duration `default:"24h" help:"Request a new port forwarding signature this long before the current one expires."`
+}
+
+func (d *DaemonCmd) Run(g *Globals, ctx context.Context) error {
+	notifiers, err := g.notifiers()
+	if err != nil {
+		return err
+	}
+	hooks, err := g.hooks()
+	if err != nil {
+		return err
+	}
+	firewall, err := g.nftConfig()
+	if err != nil {
+		return err
+	}
+	// Start from the port bound before a restart, such as the one that
+	// follows a tunnel reset, so that hooks are given it as the old port and
+	// are only fired again once it changes.
+	bound := 0
+	if tun, err := pia.ReadCache(g.CacheDir, g.IfName); err == nil {
+		bound = tun.PFSig.Port
+	}
+	old_port := bound
+	// the port each notifier was last successfully told about, and each hook
+	// last successfully fired for
+	notified := make([]int, len(notifiers))
+	fired := make([]int, len(hooks))
+	for i := range fired {
+		fired[i] = bound
+	}
+	// Ready once the loop runs, rather than after the first refresh, so that
+	// PIA being unreachable at boot does not time out the start; failures
+	// are reported in the status instead, and the watchdog catches a hang.
+	sdnotify.Notify(sdnotify.Ready)
+	for {
+		wait := d.Interval
+		tun, err := d.refresh(ctx, g)
+		if ctx.Err() != nil {
+			return d.stop()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v; retrying in %v\n", err, d.Retry)
+			sdnotify.Status(fmt.Sprintf("Refresh failed: %v", err))
+			wait = d.Retry
+		} else {
+			port := tun.PFSig.Port
+			if port != bound {
+				fmt.Printf("%s: %s (Port = %d)\n", tun.Status, tun.Message, port)
+				bound, old_port = port, bound
+			}
+			// Always rewrite the firewall, in case it has been reloaded
+			// since.
+			if err := nft.Update(port, firewall); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: %v; retrying in %v\n", err, d.Retry)
+				wait = d.Retry
+			}
+			var pending []notify.Notifier
+			var indexes []int
+			for i, n := range notifiers {
+				if notified[i] != port {
+					pending = append(pending, n)
+					indexes = append(indexes, i)
+				}
+			}
+			for j, r := range notify.SetAll(ctx, pending, port, g.Timeout) {
+				if r.Err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: %v; retrying in %v\n", r.Err, d.Retry)
+					wait = d.Retry
+				} else {
+					fmt.Printf("Notified %s of port %d\n", r.Notifier.Name(), port)
+					notified[indexes[j]] = port
+				}
+			}
+			for i, h := range hooks {
+				if fired[i] == port {
+					continue
+				}
+				if err := h.Fire(ctx, hook.NewEvent(tun, old_port)); err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: %s failed: %v; retrying in %v\n", h.Name(), err, d.Retry)
+					wait = d.Retry
+				} else {
+					fired[i] = port
+				}
+			}
+			sdnotify.Status(fmt.Sprintf("Port %d bound on %s, signature expires %s", port, g.IfName, tun.PFSig.Expiry.Format(time.RFC3339)))
+		}
+
+		if err := d.sleep(ctx, wait); err != nil {
+			return d.stop()
+		}
+	}
+}
+
+// sleep waits until wait has passed or ctx is done, feeding the systemd
+// watchdog meanwhile, if it is enabled.
+func (d *DaemonCmd) sleep(ctx context.Context, wait time.Duration) error {
+	sdnotify.Notify(sdnotify.Watchdog)
+	var feed <-chan time.Time
+	if interval := sdnotify.WatchdogInterval(); interval > 0 {
+		t := time.NewTicker(interval / 2)
+		defer t.Stop()
+		feed = t.C
+	}
+	done := time.After(wait)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-done:
+			return nil
+		case <-feed:
+			sdnotify.Notify(sdnotify.Watchdog)
+		}
+	}
+}
+
+func (d *DaemonCmd) stop() error {
+	sdnotify.Notify(sdnotify.Stopping)
+	return nil
+}
+
+// refresh binds the cached port forwarding assignment, first requesting a new
+// one if there is none, it is about to expire, or the tunnel has changed. The
+// cache is re-read on every call so that a tunnel reset by pia-setup-tunnel is
+// picked up, and only the signature is written back, so that a reset which
+// happens during the call is not undone.
+func (d *DaemonCmd) refresh(ctx context.Context, g *Globals) (*pia.Tunnel, error) {
+	tun, err := pia.ReadCache(g.CacheDir, g.IfName)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read cache: %w", err)
+	}
+	if err := ensureToken(ctx, g, tun); err != nil {
+		return nil, err
+	}
+
+	old_port := tun.PFSig.Port
+	renewed, err := tun.RefreshPFContext(ctx, d.Renew)
+	if err != nil {
+		return nil, fmt.Errorf("Could not refresh port forwarding assignment: %w", err)
+	}
+	if renewed {
+		logPortChange(old_port, tun.PFSig.Port)
+	}
+	if err := tun.SavePFSig(g.CacheDir); err != nil {
+		return nil, fmt.Errorf("Could not save cache: %w", err)
+	}
+	return tun, nil
+}
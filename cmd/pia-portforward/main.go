@@ -1,95 +1,271 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/alecthomas/kong"
+	"github.com/jdelkins/pia-tools/internal/deluge"
+	"github.com/jdelkins/pia-tools/internal/hook"
+	"github.com/jdelkins/pia-tools/internal/nft"
+	"github.com/jdelkins/pia-tools/internal/notify"
 	"github.com/jdelkins/pia-tools/internal/pia"
+	"github.com/jdelkins/pia-tools/internal/qbittorrent"
 	"github.com/jdelkins/pia-tools/internal/rtorrent"
 	"github.com/jdelkins/pia-tools/internal/transmission"
 )
 
-type CLI struct {
+type Globals struct {
 	IfName   string `short:"i" aliases:"ifname" default:"pia" help:"Name of WireGuard interface, used to determine cache filename."`
 	Username string `short:"u" name:"username" env:"PIA_USERNAME" help:"PIA username (required if token expired)."`
 	Password string `short:"p" name:"password" env:"PIA_PASSWORD" help:"PIA password (required if token expired)."`
 
-	Refresh bool `short:"r" name:"refresh" help:"Refresh cached port assignment rather than requesting a new one."`
-
 	Rtorrent      string `name:"rtorrent" env:"RTORRENT" help:"XML-RPC URL of rtorrent server (for port forward notifications)."`
 	Transmission  string `name:"transmission" env:"TRANSMISSION" help:"URL of transmission server RPC endpoint (for port forward notifications)."`
 	TransUser     string `name:"transmission-username" env:"TRANSMISSION_USERNAME" help:"Transmission server username."`
 	TransPassword string `name:"transmission-password" env:"TRANSMISSION_PASSWORD" help:"Transmission server password."`
+	Qbittorrent   string `name:"qbittorrent" env:"QBITTORRENT" help:"URL of qBittorrent Web UI (for port forward notifications)."`
+	QbitUser      string `name:"qbittorrent-username" env:"QBITTORRENT_USERNAME" help:"qBittorrent Web UI username."`
+	QbitPassword  string `name:"qbittorrent-password" env:"QBITTORRENT_PASSWORD" help:"qBittorrent Web UI password."`
+	QbitCA        string `name:"qbittorrent-ca" env:"QBITTORRENT_CA" type:"existingfile" help:"PEM file of CA certificates to trust for an HTTPS qBittorrent Web UI."`
+	Deluge        string `name:"deluge" env:"DELUGE" help:"URL of deluge-web server (for port forward notifications)."`
+	DelugePass    string `name:"deluge-password" env:"DELUGE_PASSWORD" help:"deluge-web password."`
+
+	Notify []string `name:"notify" env:"PIA_NOTIFY" sep:" " placeholder:"CLIENT+URL" help:"Notify a torrent client of the forwarded port, eg transmission+https://user:pw@host:9091/transmission/rpc. Clients are ${notifiers}. May be repeated; the environment variable takes a space-separated list."`
+
+	OnPortChange       []string `name:"on-port-change" sep:"none" placeholder:"COMMAND" help:"Run COMMAND with sh -c when the forwarded port changes. PIA_PORT, PIA_OLD_PORT, PIA_PEER_IP, PIA_SERVER_VIP and PIA_INTERFACE, among others, are set in its environment. May be repeated."`
+	Webhook            []string `name:"webhook" env:"PIA_WEBHOOK" sep:" " placeholder:"URL" help:"POST to URL when the forwarded port changes. May be repeated; the environment variable takes a space-separated list."`
+	WebhookTemplate    string   `name:"webhook-template" type:"existingfile" placeholder:"FILE" help:"Template for the webhook request body, rendered with the tunnel and port (default is a JSON object)."`
+	WebhookContentType string   `name:"webhook-content-type" default:"application/json" help:"Content-Type of the webhook request body."`
+
+	NftSet       nft.Object `name:"nft-set" placeholder:"FAMILY TABLE SET" help:"Keep the forwarded port as the only element of this nftables set (of type inet_service), eg \"inet filter pia_ports\". Requires CAP_NET_ADMIN."`
+	NftDNAT      string     `name:"nft-dnat" placeholder:"HOST[:PORT]" help:"DNAT TCP and UDP traffic arriving on the tunnel for the forwarded port to HOST (on PORT, or the forwarded port). Requires CAP_NET_ADMIN."`
+	NftDNATChain nft.Object `name:"nft-dnat-chain" default:"ip nat pia_portforward" placeholder:"FAMILY TABLE CHAIN" help:"Chain, owned by pia-portforward, in which to keep the --nft-dnat rules. It is created if necessary."`
 
 	CacheDir string `short:"c" aliases:"cachedir" default:"/var/cache/pia" help:"Directory in which to store security-sensitive cache files."`
+
+	Timeout time.Duration `short:"t" default:"30s" help:"Give up on any single request to PIA, or to a torrent client, after this long."`
 }
 
-func main() {
-	var cli CLI
-	kong.Parse(&cli, kong.Name("pia-portforward"))
+type CLI struct {
+	Globals
+
+	Run    RunCmd    `cmd:"" default:"withargs" help:"Request (or refresh) a port forwarding assignment once and notify clients (default)."`
+	Daemon DaemonCmd `cmd:"" help:"Keep the port forwarding assignment alive, re-notifying clients when the port changes."`
+}
+
+type RunCmd struct {
+	Refresh bool `short:"r" name:"refresh" help:"Refresh cached port assignment rather than requesting a new one."`
+}
+
+func (r *RunCmd) Run(g *Globals, ctx context.Context) error {
+	notifiers, err := g.notifiers()
+	if err != nil {
+		return err
+	}
+	hooks, err := g.hooks()
+	if err != nil {
+		return err
+	}
+	firewall, err := g.nftConfig()
+	if err != nil {
+		return err
+	}
 
 	// grab the cached tunnel info
-	tun, err := pia.ReadCache(cli.CacheDir, cli.IfName)
+	tun, err := pia.ReadCache(g.CacheDir, g.IfName)
 	if err != nil {
-		log.Panicf("Could not read cache: %v", err)
+		return fmt.Errorf("Could not read cache: %w", err)
 	}
-	defer func() {
-		if err := tun.SaveCache(cli.CacheDir); err != nil {
-			log.Panicf("Could not save cache: %v", err)
-		}
-	}()
 
 	// ensure our token is still valid, if not grab a new one
-	if !tun.Token.Valid() {
-		if cli.Username == "" || cli.Password == "" {
-			log.Panicf("Token expired and user/pass not provided")
-		}
-		if err := tun.NewToken(cli.Username, cli.Password); err != nil {
-			log.Panicf("Token expired; error refreshing: %v", err)
-		}
+	if err := ensureToken(ctx, g, tun); err != nil {
+		return err
 	}
 
 	// request new port unless --refresh
-	if !cli.Refresh {
-		if err := tun.NewPFSig(); err != nil {
-			log.Panicf("Could not get port forwarding signature: %v", err)
+	old_port := tun.PFSig.Port
+	if !r.Refresh {
+		if err := tun.NewPFSigContext(ctx); err != nil {
+			return fmt.Errorf("Could not get port forwarding signature: %w", err)
+		}
+		// bind the port to our virtual IP
+		if err := tun.BindPFContext(ctx); err != nil {
+			return fmt.Errorf("Could not bind port forwarding assignment: %w", err)
+		}
+	} else {
+		// refresh the active assignment, replacing it if it is stale
+		renewed, err := tun.RefreshPFContext(ctx, 0)
+		if err != nil {
+			return fmt.Errorf("Could not refresh port forwarding assignment: %w", err)
+		}
+		if renewed {
+			logPortChange(old_port, tun.PFSig.Port)
 		}
 	}
+	// PIA may well hand back the port it assigned before
+	changed := tun.PFSig.Port != old_port
+	if err := tun.SavePFSig(g.CacheDir); err != nil {
+		return fmt.Errorf("Could not save cache: %w", err)
+	}
 
-	// bind the port to our virtual IP. If already active, effectuates the refresh
-	if err := tun.BindPF(); err != nil {
-		log.Panicf("Could not bind port forwarding assignment: %v", err)
+	// success!
+	fmt.Printf("%s: %s (Port = %d)\n", tun.Status, tun.Message, tun.PFSig.Port)
+
+	// open the port in the firewall, notify torrent clients, and if the port
+	// is new, fire the hooks
+	err = nft.Update(tun.PFSig.Port, firewall)
+	err = errors.Join(err, notifyClients(ctx, notifiers, tun.PFSig.Port, g.Timeout))
+	if changed {
+		err = errors.Join(err, fireHooks(ctx, hooks, hook.NewEvent(tun, old_port)))
 	}
+	return err
+}
 
-	// notify rtorrent
-	if cli.Rtorrent != "" {
-		if err := rtorrent.Notify(cli.Rtorrent, tun.PFSig.Port); err != nil {
-			log.Panicf("Could not notify rtorrent (at %s) of assigned port: %v", cli.Rtorrent, err)
-		}
-		port, err := rtorrent.Confirm(cli.Rtorrent)
+// logPortChange reports that a new port forwarding signature was acquired.
+func logPortChange(old_port, new_port int) {
+	if old_port == 0 {
+		fmt.Fprintf(os.Stderr, "Acquired port forwarding assignment: port %d\n", new_port)
+	} else {
+		fmt.Fprintf(os.Stderr, "Re-acquired port forwarding assignment: port %d -> %d\n", old_port, new_port)
+	}
+}
+
+// ensureToken replaces tun's token if it has expired.
+func ensureToken(ctx context.Context, g *Globals, tun *pia.Tunnel) error {
+	if tun.Token.Valid() {
+		return nil
+	}
+	if g.Username == "" || g.Password == "" {
+		return fmt.Errorf("Token expired and user/pass not provided")
+	}
+	if err := tun.NewTokenContext(ctx, g.Username, g.Password); err != nil {
+		return fmt.Errorf("Token expired; error refreshing: %w", err)
+	}
+	return nil
+}
+
+// notifiers returns the clients to notify: those given with --notify, then
+// those given with the per-client flags.
+func (g *Globals) notifiers() ([]notify.Notifier, error) {
+	var ns []notify.Notifier
+	for _, spec := range g.Notify {
+		n, err := notify.Parse(spec)
 		if err != nil {
-			log.Panicf("Could not verify rtorrent port: %v", err)
-		}
-		if port != tun.PFSig.Port {
-			log.Panicf("PIA assigned us port %d, but rtorrent reports port is %d", tun.PFSig.Port, port)
+			return nil, err
 		}
+		ns = append(ns, n)
+	}
+	if g.Rtorrent != "" {
+		ns = append(ns, notify.Named("rtorrent", g.Rtorrent, &rtorrent.Client{URL: g.Rtorrent}))
 	}
+	if g.Transmission != "" {
+		ns = append(ns, notify.Named("transmission", g.Transmission, &transmission.Client{URL: g.Transmission, Username: g.TransUser, Password: g.TransPassword}))
+	}
+	if g.Qbittorrent != "" {
+		ns = append(ns, notify.Named("qbittorrent", g.Qbittorrent, &qbittorrent.Client{URL: g.Qbittorrent, Username: g.QbitUser, Password: g.QbitPassword, CAFile: g.QbitCA}))
+	}
+	if g.Deluge != "" {
+		ns = append(ns, notify.Named("deluge", g.Deluge, &deluge.Client{URL: g.Deluge, Password: g.DelugePass}))
+	}
+	return ns, nil
+}
 
-	// notify transmission
-	if cli.Transmission != "" {
-		if err := transmission.Notify(cli.Transmission, cli.TransUser, cli.TransPassword, tun.PFSig.Port); err != nil {
-			log.Panicf("Could not notify transmission (at %s) of assigned port: %v", cli.Transmission, err)
+// hooks returns the commands and webhooks to fire when the port changes.
+func (g *Globals) hooks() ([]hook.Hook, error) {
+	var hs []hook.Hook
+	for _, c := range g.OnPortChange {
+		hs = append(hs, hook.Command(c))
+	}
+	if len(g.Webhook) == 0 {
+		return hs, nil
+	}
+	tmpl, err := hook.ParseWebhookTemplate(g.WebhookTemplate)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: g.Timeout}
+	for _, u := range g.Webhook {
+		hs = append(hs, &hook.Webhook{URL: u, Template: tmpl, ContentType: g.WebhookContentType, Client: client})
+	}
+	return hs, nil
+}
+
+// fireHooks runs each of hs for e, reporting how each fared. It returns an
+// error if any of them failed.
+func fireHooks(ctx context.Context, hs []hook.Hook, e hook.Event) error {
+	failed := 0
+	for _, h := range hs {
+		if err := h.Fire(ctx, e); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s failed: %v\n", h.Name(), err)
+			failed++
 		}
-		port, err := transmission.Confirm(cli.Transmission, cli.TransUser, cli.TransPassword)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d port change hooks failed", failed, len(hs))
+	}
+	return nil
+}
+
+// nftConfig returns the nftables configuration given by the --nft-* flags.
+func (g *Globals) nftConfig() (nft.Config, error) {
+	var cfg nft.Config
+	if g.NftSet.Name != "" {
+		cfg.Set = &g.NftSet
+	}
+	if g.NftDNAT != "" {
+		to, err := netip.ParseAddrPort(g.NftDNAT)
 		if err != nil {
-			log.Panicf("Could not verify transmission port: %v", err)
+			addr, err2 := netip.ParseAddr(g.NftDNAT)
+			if err2 != nil {
+				return cfg, fmt.Errorf("--nft-dnat: %w", err)
+			}
+			to = netip.AddrPortFrom(addr, 0)
 		}
-		if port != tun.PFSig.Port {
-			log.Panicf("PIA assigned us port %d, but transmission reports port is %d", tun.PFSig.Port, port)
+		cfg.DNATChain = &g.NftDNATChain
+		cfg.DNATTo = to
+		cfg.Interface = g.IfName
+	}
+	return cfg, nil
+}
+
+// notifyClients tells each of ns about port, reporting how each fared. It
+// returns an error if any of them failed.
+func notifyClients(ctx context.Context, ns []notify.Notifier, port int, timeout time.Duration) error {
+	failed := 0
+	for _, r := range notify.SetAll(ctx, ns, port, timeout) {
+		if r.Err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", r.Err)
+			failed++
+		} else {
+			fmt.Printf("Notified %s of port %d\n", r.Notifier.Name(), port)
 		}
 	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d torrent clients could not be notified", failed, len(ns))
+	}
+	return nil
+}
 
-	// success!
-	fmt.Printf("%s: %s (Port = %d)\n", tun.Status, tun.Message, tun.PFSig.Port)
+func main() {
+	var cli CLI
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	kctx := kong.Parse(&cli,
+		kong.Name("pia-portforward"),
+		kong.Vars{"notifiers": strings.Join(notify.Names(), ", ")},
+		kong.BindTo(ctx, (*context.Context)(nil)),
+	)
+	pia.DefaultClient.Timeout = cli.Timeout
+
+	err := kctx.Run(&cli.Globals)
+	kctx.FatalIfErrorf(err)
 }
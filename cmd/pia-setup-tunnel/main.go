@@ -1,12 +1,25 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net/netip"
+	"os"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/jdelkins/pia-tools/internal/fileops"
+	"github.com/jdelkins/pia-tools/internal/flags"
+	"github.com/jdelkins/pia-tools/internal/nft"
 	"github.com/jdelkins/pia-tools/internal/pia"
+	"github.com/jdelkins/pia-tools/internal/wglink"
+	"golang.org/x/sys/unix"
 )
 
 type FileArgument map[string]string
@@ -15,16 +28,58 @@ type CLI struct {
 	IfName    string `short:"i" aliases:"ifname" default:"pia" help:"Name of interface IF; default output/template paths derive from IF under /etc/systemd/network."`
 	Username  string `short:"u" env:"PIA_USERNAME" required:"" help:"PIA username (required; may also be set via PIA_USERNAME)."`
 	Password  string `short:"p" env:"PIA_PASSWORD" required:"" help:"PIA password (required; may also be set via PIA_PASSWORD)."`
-	Region    string `short:"r" env:"PIA_REGION" default:"auto" help:"PIA region id (or 'auto')."`
+	Region    string `short:"r" env:"PIA_REGION" default:"auto" help:"PIA region id (or 'auto' for the region with the lowest ping time that passes the filter flags)."`
 	CacheDir  string `short:"c" aliases:"cachedir" default:"/var/cache/pia" help:"Path in which to store security-sensitive cache files."`
-	WGBinary  string `short:"b" default:"wg" help:"Path to the 'wg' binary from wireguard-tools."`
-	FromCache bool   `aliases:"cached" help:"Generate systemd-networkd files from the cached tunnel info."`
+	WGBinary  string `short:"b" help:"Path to the 'wg' binary from wireguard-tools; if set, keys are generated with it rather than natively."`
+	FromCache bool   `aliases:"cached" help:"Generate systemd-networkd files (or apply the tunnel) from the cached tunnel info."`
+
+	Timeout   time.Duration `short:"t" default:"30s" help:"Give up on any single request to PIA after this long."`
+	Attempts  int           `default:"3" help:"Number of passes over the region's WireGuard servers before giving up."`
+	Backoff   time.Duration `default:"2s" help:"Pause after the first failed pass; doubles after each further pass."`
+	ByLatency bool          `help:"Try the region's WireGuard servers in order of measured ping time, rather than as listed."`
+
+	InsecureServerlist bool          `help:"Do not verify the signature of PIA's serverlist. Whoever can tamper with it then chooses the WireGuard server."`
+	ServerlistMaxAge   time.Duration `default:"1h" help:"Use the serverlist cached in --cache-dir without revalidating it if it is younger than this. An older one is still used if the serverlist can't be fetched."`
+
+	// Which kind of configuration files to write.
+	Format string `enum:"networkd,wg-quick,networkmanager" default:"networkd" help:"Configuration to generate: 'networkd' renders the --netdev-file and --network-file templates; 'wg-quick' writes a built-in wg-quick config to --wg-quick-file; 'networkmanager' writes a keyfile to --nm-file."`
+
+	// How the tunnel is brought up. "none" leaves that to systemd-networkd
+	// (or whatever consumes the generated files).
+	Apply        string `enum:"none,netlink" default:"none" help:"How to bring the tunnel up: 'none' only writes the configuration files; 'netlink' instead creates and configures the interface, address and routes directly (requires CAP_NET_ADMIN)."`
+	RouteTable   uint32 `help:"With --apply=netlink, routing table for the tunnel's routes (default: main)."`
+	RouteMetric  uint32 `help:"With --apply=netlink, metric of the tunnel's routes."`
+	DefaultRoute *bool  `negatable:"" help:"With --apply=netlink, route 0.0.0.0/0 through the tunnel (default: only with a --route-table other than main)."`
 
 	// Comma-separated key/value spec parsed into a map by Kong.
 	// Example:
 	//   --netdev-file=output=/etc/systemd/network/pia.netdev,template=/etc/systemd/network/pia.netdev.tmpl,mode=0440,owner=fred,group=systemd-network
 	NetdevFile  FileArgument `name:"netdev-file" mapsep:"," sep:"=" help:"File spec for generating the .netdev file (comma-separated key=value pairs). Keys: output,template,mode,owner,group"`
 	NetworkFile FileArgument `name:"network-file" mapsep:"," sep:"=" help:"File spec for generating the .network file (comma-separated key=value pairs). Keys: output,template,mode,owner,group"`
+
+	WgQuickFile  FileArgument `name:"wg-quick-file" mapsep:"," sep:"=" help:"File spec for the wg-quick config with --format=wg-quick (comma-separated key=value pairs). Keys: output,mode,owner,group"`
+	WgQuickTable string       `name:"wg-quick-table" help:"Table= setting for the wg-quick config (a table number, 'off' or 'auto')."`
+	PostUp       []string     `name:"post-up" sep:"none" help:"PostUp= command for the wg-quick config (repeatable)."`
+	PostDown     []string     `name:"post-down" sep:"none" help:"PostDown= command for the wg-quick config (repeatable)."`
+
+	NMFile        FileArgument `name:"nm-file" mapsep:"," sep:"=" help:"File spec for the NetworkManager keyfile with --format=networkmanager (comma-separated key=value pairs). Keys: output,mode,owner,group"`
+	NMAutoconnect bool         `name:"nm-autoconnect" help:"Mark the NetworkManager connection to come up automatically."`
+	NMReload      bool         `name:"nm-reload" help:"After writing the keyfile, reload NetworkManager's connections and (re)activate the tunnel with nmcli."`
+	NMCLIBinary   string       `name:"nmcli-binary" default:"nmcli" help:"Path to the 'nmcli' binary."`
+
+	KillSwitch      bool           `name:"killswitch" help:"Install an nftables table that drops traffic leaving other than through the tunnel, to its endpoint, to its DNS servers, or to --killswitch-allow, or from --killswitch-user. DHCP is allowed too. Requires CAP_NET_ADMIN."`
+	KillSwitchTable string         `name:"killswitch-table" default:"pia_killswitch" help:"Name of the inet table, owned by pia-setup-tunnel, holding the kill switch."`
+	KillSwitchAllow []netip.Prefix `name:"killswitch-allow" default:"${lan}" placeholder:"CIDR" help:"Destinations the kill switch allows regardless, eg the LAN (default: ${lan})."`
+	KillSwitchUser  string         `name:"killswitch-user" placeholder:"USER" help:"User, by name or UID, whose traffic the kill switch allows anywhere, so that it can reach PIA's API to reset the tunnel. Root can't be exempted (default: the user running pia-setup-tunnel, unless root)."`
+
+	// How ping times are measured, for --region auto and --by-latency.
+	flags.ProbeOptions `embed:""`
+
+	// Constrains --region auto.
+	flags.Filter `embed:"" group:"Region filter (with --region auto)"`
+
+	// How --region auto chooses among the regions that pass the filter.
+	flags.ScoreOptions `embed:"" group:"Region selection (with --region auto)"`
 }
 
 func (c *CLI) AfterApply(ctx *kong.Context) error {
@@ -53,9 +108,134 @@ func (c *CLI) AfterApply(ctx *kong.Context) error {
 		c.NetworkFile["template"] = fmt.Sprintf("%s/%s.network.tmpl", pathSN, c.IfName)
 	}
 
+	// The wg-quick config holds the private key, so keep it private unless
+	// told otherwise.
+	if c.WgQuickFile == nil {
+		c.WgQuickFile = map[string]string{}
+	}
+	if v := c.WgQuickFile["output"]; v == "" {
+		c.WgQuickFile["output"] = fmt.Sprintf("/etc/wireguard/%s.conf", c.IfName)
+	}
+	if v := c.WgQuickFile["mode"]; v == "" {
+		c.WgQuickFile["mode"] = "0600"
+	}
+
+	// Likewise the NetworkManager keyfile, which NetworkManager ignores
+	// unless it is private.
+	if c.NMFile == nil {
+		c.NMFile = map[string]string{}
+	}
+	if v := c.NMFile["output"]; v == "" {
+		c.NMFile["output"] = fmt.Sprintf("/etc/NetworkManager/system-connections/%s.nmconnection", c.IfName)
+	}
+	if v := c.NMFile["mode"]; v == "" {
+		c.NMFile["mode"] = "0600"
+	}
+
 	return nil
 }
 
+// output writes the configuration files for, or directly applies, the tunnel,
+// according to --apply.
+func output(cli *CLI, tun *pia.Tunnel) {
+	switch cli.Apply {
+	case "netlink":
+		opts := wglink.Options{
+			Table:  cli.RouteTable,
+			Metric: cli.RouteMetric,
+			// In the main table, a default route through the tunnel would
+			// compete with the host's own, so it has to be asked for.
+			DefaultRoute: cli.RouteTable != 0 && cli.RouteTable != unix.RT_TABLE_MAIN,
+		}
+		if cli.DefaultRoute != nil {
+			opts.DefaultRoute = *cli.DefaultRoute
+		}
+		// The cache still holds the tunnel last applied, until this one is
+		// saved over it.
+		if prev, err := pia.ReadCache(cli.CacheDir, cli.IfName); err == nil {
+			opts.PreviousEndpointRoute = prev.EndpointRoute
+		}
+		if err := wglink.Apply(tun, opts); err != nil {
+			log.Panicf("Could not apply tunnel configuration: %v", err)
+		}
+	default:
+		switch cli.Format {
+		case "wg-quick":
+			q := fileops.WgQuick{
+				Table:    cli.WgQuickTable,
+				PostUp:   cli.PostUp,
+				PostDown: cli.PostDown,
+			}
+			if fs, err := fileops.Parse(cli.WgQuickFile); err != nil {
+				log.Panicf("Invalid --wg-quick-file: %v", err)
+			} else if err := fs.GenerateWith(tun, q); err != nil {
+				log.Panicf("Could not generate wg-quick file: %v", err)
+			}
+		case "networkmanager":
+			k := fileops.NMKeyfile{Autoconnect: cli.NMAutoconnect}
+			if fs, err := fileops.Parse(cli.NMFile); err != nil {
+				log.Panicf("Invalid --nm-file: %v", err)
+			} else if err := fs.GenerateWith(tun, k); err != nil {
+				log.Panicf("Could not generate NetworkManager keyfile: %v", err)
+			}
+			if cli.NMReload {
+				if err := nmReload(cli.NMCLIBinary, tun.Interface); err != nil {
+					log.Panicf("Could not reload NetworkManager connection: %v", err)
+				}
+			}
+		default:
+			writeFiles(cli.NetdevFile, cli.NetworkFile, tun)
+		}
+	}
+}
+
+// killSwitch installs (or replaces) the kill switch for tun, if --killswitch.
+func killSwitch(cli *CLI, tun *pia.Tunnel) {
+	if !cli.KillSwitch {
+		return
+	}
+	endpoint, err := netip.ParseAddr(tun.ServerIp)
+	if err != nil {
+		log.Panicf("Invalid server IP %q: %v", tun.ServerIp, err)
+	}
+	ks := nft.KillSwitch{
+		Table:     cli.KillSwitchTable,
+		Interface: tun.Interface,
+		Endpoint:  netip.AddrPortFrom(endpoint, uint16(tun.ServerPort)),
+		APIPort:   pia.DefaultWgAPIPort,
+		Allowed:   cli.KillSwitchAllow,
+		UID:       os.Geteuid(),
+	}
+	if cli.KillSwitchUser != "" {
+		u, err := user.Lookup(cli.KillSwitchUser)
+		if err != nil {
+			u, err = user.LookupId(cli.KillSwitchUser)
+		}
+		if err != nil {
+			log.Panicf("Invalid --killswitch-user %q: %v", cli.KillSwitchUser, err)
+		}
+		if ks.UID, err = strconv.Atoi(u.Uid); err != nil {
+			log.Panicf("Invalid --killswitch-user %q: %v", cli.KillSwitchUser, err)
+		}
+		if ks.UID == 0 {
+			log.Panicf("Invalid --killswitch-user %q: root can't be exempted from the kill switch", cli.KillSwitchUser)
+		}
+	}
+	if ks.UID == 0 {
+		fmt.Fprintf(os.Stderr, "Warning: the kill switch exempts no user, so the tunnel can only be reset while it is up\n")
+	}
+	for _, d := range tun.DnsServers {
+		addr, err := netip.ParseAddr(d)
+		if err != nil {
+			log.Panicf("Invalid DNS server %q: %v", d, err)
+		}
+		ks.DNS = append(ks.DNS, addr)
+	}
+	if err := nft.InstallKillSwitch(ks); err != nil {
+		log.Panicf("%v", err)
+	}
+}
+
 func writeFiles(netdev, network FileArgument, tun *pia.Tunnel) {
 	if fs, err := fileops.Parse(netdev); err != nil {
 		log.Panicf("Invalid --netdev-file: %v", err)
@@ -71,7 +251,22 @@ func writeFiles(netdev, network FileArgument, tun *pia.Tunnel) {
 
 func main() {
 	var cli CLI
-	kong.Parse(&cli, kong.Name("pia-setup-tunnel"))
+	lan := make([]string, len(nft.DefaultAllowed))
+	for i, p := range nft.DefaultAllowed {
+		lan[i] = p.String()
+	}
+	kong.Parse(&cli,
+		kong.Name("pia-setup-tunnel"),
+		kong.Vars{"lan": strings.Join(lan, ","), "pf_only": "true", "throughput_path": pia.DefaultThroughputPath},
+	)
+	pia.DefaultClient.Timeout = cli.Timeout
+	pia.DefaultClient.Retry = pia.RetryPolicy{Attempts: cli.Attempts, Backoff: cli.Backoff}
+	pia.DefaultClient.InsecureServerlist = cli.InsecureServerlist
+	pia.DefaultClient.ServerlistCacheDir = cli.CacheDir
+	pia.DefaultClient.ServerlistMaxAge = cli.ServerlistMaxAge
+	cli.ProbeOptions.Options().Configure(pia.DefaultClient)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// If directed to use cached info, just read the cache and write the files
 	if cli.FromCache {
@@ -80,34 +275,66 @@ func main() {
 		if err != nil {
 			log.Panicf("Could not read cache: %v", err)
 		}
-		writeFiles(cli.NetdevFile, cli.NetworkFile, tun)
+		output(&cli, tun)
+		killSwitch(&cli, tun)
+		// --apply=netlink records the endpoint route afresh, which
+		// --route-table or --route-metric may have changed
+		if cli.Apply == "netlink" {
+			if err := tun.SaveCache(cli.CacheDir); err != nil {
+				log.Panicf("Could not save cache: %v", err)
+			}
+		}
 		return
 	}
 
 	// Find the "best" reg_id if requested
 	var reg *pia.Region
+	var sel *pia.Selection
 	if cli.Region == "auto" || cli.Region == "" {
-		regions, err := pia.RegionsWithPingTime()
+		regions, err := pia.RegionsContext(ctx)
 		if err != nil {
 			log.Panicf("Could not enumerate regions: %v", err)
 		}
-		// region list should be sorted by ping time from best to worst, so we
-		// just need to find the first one in the list that has both port
-		// forwarding and wireguard
-		for i := range regions {
-			r := &regions[i]
-			if r.HasWg() && r.PortForward {
-				reg = r
-				fmt.Printf("Selected region %s (%s), having ping time %d ms\n", r.Id, r.Name, r.PingTime.Milliseconds())
-				break
+		// only probe the regions that could pass the filter, which must be
+		// online and have wireguard, then choose among those that still do,
+		// as --strategy directs
+		filter := cli.Filter.Options()
+		filter.WireGuard = true
+		filter.Online = true
+		static := filter
+		static.MaxPing = 0
+		regions = static.Apply(regions)
+		var unreachable []string
+		for res := range pia.DefaultClient.ProbeRegions(ctx, regions) {
+			if res.Err != nil {
+				unreachable = append(unreachable, fmt.Sprintf("%s: %v", res.Region.Id, res.Err))
 			}
 		}
+		if ctx.Err() != nil {
+			log.Panicf("Could not probe regions: %v", ctx.Err())
+		}
+		regions = filter.Apply(regions)
+		if len(regions) == 0 {
+			for _, u := range unreachable {
+				fmt.Fprintf(os.Stderr, "Unreachable: %s\n", u)
+			}
+			log.Panicf("No region passes the region filter")
+		}
+		previous := ""
+		if prev, err := pia.ReadCache(cli.CacheDir, cli.IfName); err == nil {
+			previous = prev.Region.Id
+		}
+		reg, sel, err = pia.DefaultClient.SelectRegion(ctx, regions, previous, cli.ScoreOptions.Options())
+		if err != nil {
+			log.Panicf("Could not select a region: %v", err)
+		}
+		fmt.Printf("Selected region %s (%s), having ping time %d ms and %.0f%% packet loss: %s\n", reg.Id, reg.Name, reg.PingTime.Milliseconds(), reg.PacketLoss, sel.Reason)
 	}
 
 	// Get configured region details, if not "auto"
 	if reg == nil {
 		var err error
-		reg, err = pia.FindRegion(cli.Region)
+		reg, err = pia.FindRegionContext(ctx, cli.Region)
 		if err != nil {
 			log.Panicf("%v", err)
 		}
@@ -115,6 +342,7 @@ func main() {
 
 	// Create a Tunnel struct and populate it with fresh WG keys and an access token
 	tun := pia.NewTunnel(reg, cli.IfName)
+	tun.Selection = sel
 	defer func() {
 		if err := tun.SaveCache(cli.CacheDir); err != nil {
 			log.Panicf("Could not save cache: %v", err)
@@ -124,18 +352,23 @@ func main() {
 		log.Panicf("Could not generate keypair: %v", err)
 	}
 	if !tun.Token.Valid() {
-		if err := tun.NewToken(cli.Username, cli.Password); err != nil {
+		if err := tun.NewTokenContext(ctx, cli.Username, cli.Password); err != nil {
 			log.Panicf("Could not get token: %v", err)
 		}
 	}
 
-	// Register the WG keys to our account (identified by access token)
-	if err := tun.Activate(); err != nil {
+	// Register the WG keys to our account (identified by access token),
+	// failing over between the region's servers as needed
+	if cli.ByLatency {
+		pia.DefaultClient.SortWgServersByLatency(ctx, &tun.Region)
+	}
+	if err := tun.ActivateContext(ctx); err != nil {
 		log.Panicf("Could not register public key: %v", err)
 	}
 
-	// Finally, populate the templates
-	writeFiles(cli.NetdevFile, cli.NetworkFile, tun)
+	// Finally, populate the templates or configure the interface
+	output(&cli, tun)
+	killSwitch(&cli, tun)
 
 	fmt.Println(tun.Status)
 }
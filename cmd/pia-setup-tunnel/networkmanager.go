@@ -0,0 +1,18 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// nmReload has NetworkManager re-read its connection files and (re)activate the
+// tunnel's connection, so that new keys and endpoints take effect.
+func nmReload(nmcli_binary, id string) error {
+	if out, err := exec.Command(nmcli_binary, "connection", "reload").CombinedOutput(); err != nil {
+		return fmt.Errorf("%v; %s", err, out)
+	}
+	if out, err := exec.Command(nmcli_binary, "connection", "up", "id", id).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v; %s", err, out)
+	}
+	return nil
+}
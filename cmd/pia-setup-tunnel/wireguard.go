@@ -7,9 +7,23 @@ import (
 	"strings"
 
 	"github.com/jdelkins/pia-tools/internal/pia"
+	"github.com/jdelkins/pia-tools/internal/wgkey"
 )
 
+// genKeypair populates tun with a fresh WireGuard keypair. Keys are generated
+// natively unless wg_binary is set, in which case `wg genkey` and `wg pubkey`
+// are used instead.
 func genKeypair(tun *pia.Tunnel, wg_binary string) error {
+	if wg_binary == "" {
+		priv, err := wgkey.GeneratePrivate()
+		if err != nil {
+			return err
+		}
+		tun.PrivateKey = priv.String()
+		tun.PublicKey = priv.Public().String()
+		return nil
+	}
+
 	privkey_b, err := exec.Command(wg_binary, "genkey").CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("%v; %s", err, privkey_b)
@@ -38,6 +38,10 @@
                 type = "app";
                 program = "${pkg}/bin/pia-portforward";
               };
+              healthcheck = {
+                type = "app";
+                program = "${pkg}/bin/pia-healthcheck";
+              };
             };
 
             packages = {
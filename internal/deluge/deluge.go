@@ -0,0 +1,148 @@
+// Package deluge sets the listening port of a Deluge client through the
+// JSON-RPC API of deluge-web.
+package deluge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"strings"
+)
+
+// Client notifies a Deluge instance through deluge-web.
+type Client struct {
+	// URL is the base URL of deluge-web, eg http://localhost:8112; the
+	// tool adds /json.
+	URL      string
+	Password string
+}
+
+// SetPort sets Deluge's incoming port range to the single port given, and
+// turns off its random port selection.
+func (c *Client) SetPort(ctx context.Context, port int) error {
+	s, err := c.login(ctx)
+	if err != nil {
+		return err
+	}
+	config := map[string]any{
+		"listen_ports": []int{port, port},
+		"random_port":  false,
+	}
+	return s.call(ctx, "core.set_config", []any{config}, nil)
+}
+
+// CurrentPort returns the first port of Deluge's incoming port range.
+func (c *Client) CurrentPort(ctx context.Context) (int, error) {
+	s, err := c.login(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var ports []int
+	if err := s.call(ctx, "core.get_config_value", []any{"listen_ports"}, &ports); err != nil {
+		return 0, err
+	}
+	if len(ports) == 0 {
+		return 0, fmt.Errorf("deluge returned an empty listen_ports")
+	}
+	return ports[0], nil
+}
+
+type session struct {
+	url    string
+	client *http.Client
+	id     int
+}
+
+// login authenticates to deluge-web and, if it is not already connected to a
+// Deluge daemon, connects it to the first one configured in its connection
+// manager.
+func (c *Client) login(ctx context.Context) (*session, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &session{
+		url:    strings.TrimSuffix(c.URL, "/") + "/json",
+		client: &http.Client{Jar: jar},
+	}
+
+	var ok bool
+	if err := s.call(ctx, "auth.login", []any{c.Password}, &ok); err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("deluge-web login failed")
+	}
+
+	var connected bool
+	if err := s.call(ctx, "web.connected", []any{}, &connected); err != nil {
+		return nil, err
+	}
+	if connected {
+		return s, nil
+	}
+	// Each host is [id, address, port, status]
+	var hosts [][]any
+	if err := s.call(ctx, "web.get_hosts", []any{}, &hosts); err != nil {
+		return nil, err
+	}
+	if len(hosts) == 0 || len(hosts[0]) == 0 {
+		return nil, fmt.Errorf("deluge-web is not connected to a daemon, and has no hosts configured")
+	}
+	if err := s.call(ctx, "web.connect", []any{hosts[0][0]}, nil); err != nil {
+		return nil, fmt.Errorf("could not connect deluge-web to daemon: %w", err)
+	}
+	return s, nil
+}
+
+// call invokes method with params, decoding its result into result unless
+// that is nil.
+func (s *session) call(ctx context.Context, method string, params []any, result any) error {
+	s.id++
+	b, err := json.Marshal(map[string]any{
+		"method": method,
+		"params": params,
+		"id":     s.id,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("deluge %s: %s", method, resp.Status)
+	}
+
+	var r struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Message string `json:"message"`
+			Code    int    `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("deluge %s: %w", method, err)
+	}
+	if r.Error != nil {
+		return fmt.Errorf("deluge %s: %s (code %d)", method, r.Error.Message, r.Error.Code)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(r.Result, result); err != nil {
+		return fmt.Errorf("deluge %s: unexpected result %s", method, r.Result)
+	}
+	return nil
+}
@@ -3,12 +3,14 @@ package fileops
 import (
 	"encoding"
 	"fmt"
+	"io"
 	"os"
 	"os/user"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/Masterminds/sprig/v3"
 	"github.com/jdelkins/pia-tools/internal/pia"
@@ -89,31 +91,73 @@ func Parse(m map[string]string) (*FileSpec, error) {
 	return out, nil
 }
 
+// Renderer produces the contents of a generated file from a tunnel.
+type Renderer interface {
+	Render(w io.Writer, tun *pia.Tunnel) error
+}
+
+// RendererFunc adapts a function to the Renderer interface.
+type RendererFunc func(w io.Writer, tun *pia.Tunnel) error
+
+func (f RendererFunc) Render(w io.Writer, tun *pia.Tunnel) error {
+	return f(w, tun)
+}
+
+// writeHeader writes the comment that heads each of the built-in formats,
+// saying where the file came from.
+func writeHeader(w io.Writer, tun *pia.Tunnel) {
+	fmt.Fprintf(w, "# Configuration for privateinternetaccess.com WireGuard Tunnel\n")
+	fmt.Fprintf(w, "# Generated by pia-setup-tunnel on %s\n", time.Now().Format("2006-01-02 15:04:05 MST"))
+	if s := tun.WgServer(); s != nil {
+		fmt.Fprintf(w, "# Region is %s (%s %s)\n", tun.Region.Id, tun.Region.Name, s.Cn)
+	}
+}
+
+// FuncMap returns the functions available to templates: sprig's, plus
+// "server", which returns the WireGuard server of a *pia.Tunnel.
+func FuncMap() template.FuncMap {
+	funcs := sprig.TxtFuncMap()
+	// Provide a helper used by the stock pia.netdev.tmpl.
+	funcs["server"] = func(tuni any) any {
+		t := tuni.(*pia.Tunnel)
+		return any(t.WgServer())
+	}
+	return funcs
+}
+
 // Generate renders the template and writes it to Output, applying owner/group/mode
 // overrides if provided.
 func (s *FileSpec) Generate(tun *pia.Tunnel) error {
 	if s == nil {
 		return fmt.Errorf("nil FileSpec")
 	}
-	if strings.TrimSpace(s.Output) == "" {
-		return fmt.Errorf("missing output")
-	}
 	if strings.TrimSpace(s.Template) == "" {
 		return fmt.Errorf("missing template")
 	}
 
-	// Provide a helper used by the stock pia.netdev.tmpl.
-	wgserver := func(tuni any) any {
-		t := tuni.(*pia.Tunnel)
-		return any(t.Region.WgServer())
-	}
-	extraFuncs := template.FuncMap{"server": wgserver}
-
-	tmpl, err := template.New(filepath.Base(s.Template)).Funcs(sprig.TxtFuncMap()).Funcs(extraFuncs).ParseFiles(s.Template)
+	tmpl, err := template.New(filepath.Base(s.Template)).Funcs(FuncMap()).ParseFiles(s.Template)
 	if err != nil {
 		return fmt.Errorf("error parsing template from %s: %w", s.Template, err)
 	}
 
+	return s.GenerateWith(tun, RendererFunc(func(w io.Writer, tun *pia.Tunnel) error {
+		if err := tmpl.Execute(w, tun); err != nil {
+			return fmt.Errorf("error executing template: %w", err)
+		}
+		return nil
+	}))
+}
+
+// GenerateWith writes the output of r to Output, ignoring Template, and
+// applies owner/group/mode overrides if provided.
+func (s *FileSpec) GenerateWith(tun *pia.Tunnel, r Renderer) error {
+	if s == nil {
+		return fmt.Errorf("nil FileSpec")
+	}
+	if strings.TrimSpace(s.Output) == "" {
+		return fmt.Errorf("missing output")
+	}
+
 	// Choose file mode for initial create.
 	perm := os.FileMode(0o666)
 	if s.Mode != nil {
@@ -134,8 +178,8 @@ func (s *FileSpec) Generate(tun *pia.Tunnel) error {
 		_ = os.Remove(tmpPath)
 	}()
 
-	if err := tmpl.Execute(f, tun); err != nil {
-		return fmt.Errorf("error executing template: %w", err)
+	if err := r.Render(f, tun); err != nil {
+		return err
 	}
 	if err := f.Sync(); err != nil {
 		return err
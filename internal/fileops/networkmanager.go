@@ -0,0 +1,85 @@
+package fileops
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jdelkins/pia-tools/internal/pia"
+)
+
+// NMKeyfile renders a NetworkManager keyfile (.nmconnection) describing a
+// WireGuard connection for a tunnel. NetworkManager ignores keyfiles that are
+// not owned by root with mode 0600.
+type NMKeyfile struct {
+	// ID is the connection name; empty means the tunnel's interface name.
+	ID string
+
+	// Autoconnect brings the connection up automatically at boot.
+	Autoconnect bool
+
+	// Keepalive is the peer's persistent-keepalive; 0 means 25 seconds.
+	Keepalive time.Duration
+}
+
+var _ Renderer = NMKeyfile{}
+
+// UUID is derived from the interface name so that regenerating the keyfile
+// updates the same connection rather than creating a new one.
+func (k NMKeyfile) UUID(tun *pia.Tunnel) string {
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte("https://github.com/jdelkins/pia-tools#"+tun.Interface)).String()
+}
+
+func (k NMKeyfile) Render(w io.Writer, tun *pia.Tunnel) error {
+	id := k.ID
+	if id == "" {
+		id = tun.Interface
+	}
+	keepalive := k.Keepalive
+	if keepalive == 0 {
+		keepalive = 25 * time.Second
+	}
+
+	b := bufio.NewWriter(w)
+	writeHeader(b, tun)
+
+	fmt.Fprintf(b, "\n[connection]\n")
+	fmt.Fprintf(b, "id=%s\n", id)
+	fmt.Fprintf(b, "uuid=%s\n", k.UUID(tun))
+	fmt.Fprintf(b, "type=wireguard\n")
+	fmt.Fprintf(b, "interface-name=%s\n", tun.Interface)
+	fmt.Fprintf(b, "autoconnect=%t\n", k.Autoconnect)
+
+	fmt.Fprintf(b, "\n[wireguard]\n")
+	fmt.Fprintf(b, "private-key=%s\n", tun.PrivateKey)
+
+	fmt.Fprintf(b, "\n[wireguard-peer.%s]\n", tun.ServerPubkey)
+	fmt.Fprintf(b, "endpoint=%s:%d\n", tun.ServerIp, tun.ServerPort)
+	fmt.Fprintf(b, "persistent-keepalive=%d\n", int(keepalive/time.Second))
+	fmt.Fprintf(b, "allowed-ips=0.0.0.0/0;\n")
+
+	fmt.Fprintf(b, "\n[ipv4]\n")
+	fmt.Fprintf(b, "method=manual\n")
+	fmt.Fprintf(b, "address1=%s/32\n", tun.PeerIp)
+	// The server's virtual IP and the DNS servers are only reachable through
+	// the tunnel.
+	fmt.Fprintf(b, "route1=%s/32\n", tun.ServerVip)
+	for i, d := range tun.DnsServers {
+		fmt.Fprintf(b, "route%d=%s/32,%s\n", i+2, d, tun.ServerVip)
+		fmt.Fprintf(b, "route%d_options=onlink=true\n", i+2)
+	}
+	if len(tun.DnsServers) > 0 {
+		fmt.Fprintf(b, "dns=%s;\n", strings.Join(tun.DnsServers, ";"))
+		// Send all queries to PIA's resolvers while the tunnel is up.
+		fmt.Fprintf(b, "dns-search=~;\n")
+		fmt.Fprintf(b, "dns-priority=-50\n")
+	}
+
+	fmt.Fprintf(b, "\n[ipv6]\n")
+	fmt.Fprintf(b, "method=disabled\n")
+
+	return b.Flush()
+}
@@ -0,0 +1,68 @@
+package fileops
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jdelkins/pia-tools/internal/pia"
+)
+
+// WgQuick renders a wg-quick(8) configuration for a tunnel. It is a built-in
+// alternative to the systemd-networkd templates.
+type WgQuick struct {
+	// Table is passed through as wg-quick's Table= setting: a table
+	// number or name, "off", or "auto". Empty omits it (ie "auto").
+	Table string
+
+	// PostUp and PostDown are shell commands run by wg-quick after the
+	// interface is brought up or down, eg to install policy routing rules.
+	PostUp   []string
+	PostDown []string
+
+	// Keepalive is the peer's PersistentKeepalive; 0 means 25 seconds.
+	Keepalive time.Duration
+}
+
+var _ Renderer = WgQuick{}
+
+func (q WgQuick) Render(w io.Writer, tun *pia.Tunnel) error {
+	for _, v := range append(append([]string{q.Table}, q.PostUp...), q.PostDown...) {
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("wg-quick setting %q must not contain newlines", v)
+		}
+	}
+	keepalive := q.Keepalive
+	if keepalive == 0 {
+		keepalive = 25 * time.Second
+	}
+
+	b := bufio.NewWriter(w)
+	writeHeader(b, tun)
+
+	fmt.Fprintf(b, "\n[Interface]\n")
+	fmt.Fprintf(b, "PrivateKey = %s\n", tun.PrivateKey)
+	fmt.Fprintf(b, "Address = %s/32\n", tun.PeerIp)
+	if len(tun.DnsServers) > 0 {
+		fmt.Fprintf(b, "DNS = %s\n", strings.Join(tun.DnsServers, ", "))
+	}
+	if q.Table != "" {
+		fmt.Fprintf(b, "Table = %s\n", q.Table)
+	}
+	for _, c := range q.PostUp {
+		fmt.Fprintf(b, "PostUp = %s\n", c)
+	}
+	for _, c := range q.PostDown {
+		fmt.Fprintf(b, "PostDown = %s\n", c)
+	}
+
+	fmt.Fprintf(b, "\n[Peer]\n")
+	fmt.Fprintf(b, "PublicKey = %s\n", tun.ServerPubkey)
+	fmt.Fprintf(b, "Endpoint = %s:%d\n", tun.ServerIp, tun.ServerPort)
+	fmt.Fprintf(b, "AllowedIPs = 0.0.0.0/0\n")
+	fmt.Fprintf(b, "PersistentKeepalive = %d\n", int(keepalive/time.Second))
+
+	return b.Flush()
+}
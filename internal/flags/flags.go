@@ -0,0 +1,58 @@
+// Package flags declares the command-line flags that the commands share, and
+// maps them onto the pia package's options, which know nothing of kong.
+package flags
+
+import (
+	"time"
+
+	"github.com/jdelkins/pia-tools/internal/pia"
+)
+
+// Filter holds the region filter flags. Whether --pf-only is on by default
+// is up to the command, through the pf_only variable.
+type Filter struct {
+	PortForward      bool          `name:"pf-only" default:"${pf_only}" negatable:"" help:"Only regions that support port forwarding."`
+	WireGuard        bool          `name:"wg-only" help:"Only regions with a WireGuard server."`
+	Online           bool          `name:"online-only" help:"Only regions that PIA has not marked offline."`
+	Countries        []string      `name:"country" placeholder:"CC" help:"Only regions in these countries, by ISO code, eg US. May be repeated."`
+	ExcludeCountries []string      `name:"exclude-country" placeholder:"CC" help:"Exclude regions in these countries. May be repeated."`
+	Exclude          []string      `name:"exclude" placeholder:"ID" help:"Exclude these regions, by id. May be repeated."`
+	MaxPing          time.Duration `name:"max-ping" help:"Only regions whose ping time is at most this; unreachable regions are excluded too."`
+}
+
+// Options returns the filter the flags describe.
+func (f Filter) Options() pia.Filter {
+	return pia.Filter(f)
+}
+
+// ProbeOptions holds the flags that select how region latency is measured.
+type ProbeOptions struct {
+	Probe         string        `enum:"icmp,udp-unprivileged,tcp-connect" default:"udp-unprivileged" help:"How to measure latency: 'icmp' pings over a raw socket (requires CAP_NET_RAW); 'udp-unprivileged' pings over an ICMP datagram socket (requires net.ipv4.ping_group_range to include the user's group); 'tcp-connect' times TCP handshakes with the WireGuard server's API port, or the meta server's HTTPS port, and requires nothing."`
+	ProbeCount    int           `default:"3" help:"Number of probes sent to each server."`
+	ProbeTimeout  time.Duration `default:"1s" help:"Give up waiting for a server's probes to be answered after this long."`
+	Parallel      int           `default:"16" help:"Number of regions to probe at once."`
+	ProbeDeadline time.Duration `default:"30s" help:"Give up probing regions after this long altogether; those not yet probed are unreachable."`
+}
+
+// Options returns the probe options the flags describe.
+func (o ProbeOptions) Options() pia.ProbeOptions {
+	return pia.ProbeOptions(o)
+}
+
+// ScoreOptions holds the flags that govern automatic region selection. The
+// default --throughput-path comes from the throughput_path variable.
+type ScoreOptions struct {
+	Strategy             string        `enum:"ping,score" default:"ping" help:"How to choose a region: 'ping' takes the lowest ping time; 'score' weighs ping time, packet loss and, with --throughput-probe, throughput, and prefers the region used last time."`
+	LossWeight           float64       `default:"20" help:"Score added for each percent of packet loss, in ms of ping time."`
+	ThroughputProbe      bool          `help:"Also measure download throughput from the meta servers of the best-scoring regions, one at a time."`
+	ThroughputWeight     float64       `default:"1" help:"Score subtracted for each Mbit/s of throughput, in ms of ping time."`
+	ThroughputCandidates int           `default:"5" help:"Number of regions, best-scoring first, whose throughput is measured; the others are not considered."`
+	ThroughputDuration   time.Duration `default:"2s" help:"Measure each region's throughput for at most this long."`
+	ThroughputPath       string        `default:"${throughput_path}" help:"Path fetched from the meta server to measure throughput."`
+	StickyMargin         float64       `default:"20" help:"Keep the region used last time unless another scores better by more than this."`
+}
+
+// Options returns the score options the flags describe.
+func (o ScoreOptions) Options() pia.ScoreOptions {
+	return pia.ScoreOptions(o)
+}
@@ -0,0 +1,85 @@
+// Package health checks that a PIA WireGuard tunnel is actually passing
+// traffic, rather than merely configured.
+package health
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-ping/ping"
+	"github.com/jdelkins/pia-tools/internal/pia"
+	"github.com/jdelkins/pia-tools/internal/wglink"
+)
+
+// Thresholds beyond which a tunnel is considered unhealthy.
+type Thresholds struct {
+	// MaxHandshakeAge is how long ago the last WireGuard handshake may
+	// have been. WireGuard re-handshakes every two minutes while the
+	// tunnel is in use, and the persistent keepalive keeps it in use.
+	MaxHandshakeAge time.Duration
+	// PingCount echo requests are sent to each of the server's virtual IP
+	// and a DNS server, waiting at most PingTimeout for the replies.
+	PingCount   int
+	PingTimeout time.Duration
+	// MaxLoss is the percentage of echo requests that may go unanswered.
+	MaxLoss float64
+	// Privileged sends raw ICMP, which requires CAP_NET_RAW, rather than
+	// unprivileged ICMP datagrams, which require net.ipv4.ping_group_range
+	// to include the user's group.
+	Privileged bool
+}
+
+// Check verifies that tun is up: that its interface has had a recent
+// handshake with the server, and that the server's virtual IP and the first
+// DNS server answer pings sent from the tunnel's address. It returns the
+// first problem found.
+func Check(ctx context.Context, tun *pia.Tunnel, th Thresholds) error {
+	last, err := wglink.LastHandshake(tun.Interface)
+	if err != nil {
+		return err
+	}
+	if last.IsZero() {
+		return fmt.Errorf("no handshake with %s on %s", tun.ServerIp, tun.Interface)
+	}
+	if age := time.Since(last); age > th.MaxHandshakeAge {
+		return fmt.Errorf("last handshake with %s on %s was %v ago", tun.ServerIp, tun.Interface, age.Round(time.Second))
+	}
+
+	targets := []string{tun.ServerVip}
+	if len(tun.DnsServers) > 0 {
+		targets = append(targets, tun.DnsServers[0])
+	}
+	for _, ip := range targets {
+		if err := pingThrough(ctx, tun, ip, th); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pingThrough pings ip from the tunnel's peer address, so that the pings
+// take the tunnel even if it is routed by policy.
+func pingThrough(ctx context.Context, tun *pia.Tunnel, ip string, th Thresholds) error {
+	pinger, err := ping.NewPinger(ip)
+	if err != nil {
+		return err
+	}
+	pinger.Source = tun.PeerIp
+	pinger.Count = th.PingCount
+	pinger.Timeout = th.PingTimeout
+	pinger.SetPrivileged(th.Privileged)
+	stop := context.AfterFunc(ctx, pinger.Stop)
+	defer stop()
+	if err := pinger.Run(); err != nil {
+		return fmt.Errorf("could not ping %s: %w", ip, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stats := pinger.Statistics()
+	if stats.PacketLoss > th.MaxLoss {
+		return fmt.Errorf("%.0f%% packet loss pinging %s through %s", stats.PacketLoss, ip, tun.Interface)
+	}
+	return nil
+}
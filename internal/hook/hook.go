@@ -0,0 +1,144 @@
+// Package hook pushes a forwarded port to arbitrary consumers, by running
+// commands or POSTing to webhooks, when the port changes.
+package hook
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/jdelkins/pia-tools/internal/fileops"
+	"github.com/jdelkins/pia-tools/internal/pia"
+)
+
+// Event describes a new port forwarding assignment. It is the data passed to
+// webhook templates, so eg {{ .Port }}, {{ .PeerIp }} and {{ .PFSig.Expiry }}
+// are all available.
+type Event struct {
+	*pia.Tunnel
+	Port int
+	// OldPort is the previously assigned port, or 0 if there was none.
+	OldPort int
+}
+
+// NewEvent returns an Event for tun's current assignment.
+func NewEvent(tun *pia.Tunnel, old_port int) Event {
+	return Event{Tunnel: tun, Port: tun.PFSig.Port, OldPort: old_port}
+}
+
+// Env returns e as environment variables, in the form used by exec.Cmd.
+func (e Event) Env() []string {
+	return []string{
+		"PIA_PORT=" + strconv.Itoa(e.Port),
+		"PIA_OLD_PORT=" + strconv.Itoa(e.OldPort),
+		"PIA_PORT_EXPIRES=" + e.PFSig.Expiry.Format(time.RFC3339),
+		"PIA_PEER_IP=" + e.PeerIp,
+		"PIA_SERVER_VIP=" + e.ServerVip,
+		"PIA_SERVER_IP=" + e.ServerIp,
+		"PIA_INTERFACE=" + e.Interface,
+		"PIA_REGION=" + e.Region.Id,
+	}
+}
+
+type Hook interface {
+	// Name identifies the hook in messages.
+	Name() string
+	Fire(ctx context.Context, e Event) error
+}
+
+// Command is a shell command, run with sh -c and the variables from
+// Event.Env added to its environment.
+type Command string
+
+func (c Command) Name() string {
+	return fmt.Sprintf("hook %q", string(c))
+}
+
+func (c Command) Fire(ctx context.Context, e Event) error {
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", string(c))
+	cmd.Env = append(os.Environ(), e.Env()...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// DefaultWebhookTemplate renders a JSON object describing the assignment.
+// It deliberately omits the tunnel's keys and token.
+const DefaultWebhookTemplate = `{{ dict
+	"port" .Port
+	"old_port" .OldPort
+	"expires_at" .PFSig.Expiry
+	"interface" .Interface
+	"peer_ip" .PeerIp
+	"server_vip" .ServerVip
+	"server_ip" .ServerIp
+	"region" .Region.Id
+	| toJson }}
+`
+
+// ParseWebhookTemplate parses the template in the file path, or
+// DefaultWebhookTemplate if path is empty, with fileops.FuncMap.
+func ParseWebhookTemplate(path string) (*template.Template, error) {
+	if path == "" {
+		return template.New("webhook").Funcs(fileops.FuncMap()).Parse(DefaultWebhookTemplate)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(path).Funcs(fileops.FuncMap()).Parse(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing template from %s: %w", path, err)
+	}
+	return tmpl, nil
+}
+
+// Webhook POSTs the rendered Template to URL.
+type Webhook struct {
+	URL         string
+	Template    *template.Template
+	ContentType string
+	Client      *http.Client
+}
+
+func (w *Webhook) Name() string {
+	if u, err := url.Parse(w.URL); err == nil {
+		return "webhook " + u.Redacted()
+	}
+	return "webhook"
+}
+
+func (w *Webhook) Fire(ctx context.Context, e Event) error {
+	var body bytes.Buffer
+	if err := w.Template.Execute(&body, e); err != nil {
+		return fmt.Errorf("error executing template: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", w.URL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", w.ContentType)
+	req.Header.Set("User-Agent", pia.DefaultUserAgent)
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
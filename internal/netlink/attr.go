@@ -0,0 +1,143 @@
+package netlink
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Attr is a decoded netlink attribute. Type has the nested and byte-order
+// flag bits cleared.
+type Attr struct {
+	Type uint16
+	Data []byte
+}
+
+func (a Attr) Uint8() uint8 {
+	if len(a.Data) < 1 {
+		return 0
+	}
+	return a.Data[0]
+}
+
+func (a Attr) Uint16() uint16 {
+	if len(a.Data) < 2 {
+		return 0
+	}
+	return binary.NativeEndian.Uint16(a.Data)
+}
+
+func (a Attr) Uint32() uint32 {
+	if len(a.Data) < 4 {
+		return 0
+	}
+	return binary.NativeEndian.Uint32(a.Data)
+}
+
+func (a Attr) Uint64() uint64 {
+	if len(a.Data) < 8 {
+		return 0
+	}
+	return binary.NativeEndian.Uint64(a.Data)
+}
+
+func (a Attr) String() string {
+	return strings.TrimRight(string(a.Data), "\x00")
+}
+
+// Nested decodes the attribute's payload as a list of attributes.
+func (a Attr) Nested() ([]Attr, error) {
+	return ParseAttrs(a.Data)
+}
+
+// ParseAttrs decodes a sequence of attributes.
+func ParseAttrs(b []byte) ([]Attr, error) {
+	var out []Attr
+	for len(b) >= unix.SizeofNlAttr {
+		l := int(binary.NativeEndian.Uint16(b[0:2]))
+		t := binary.NativeEndian.Uint16(b[2:4])
+		if l < unix.SizeofNlAttr || l > len(b) {
+			return nil, fmt.Errorf("netlink: malformed attribute length %d", l)
+		}
+		out = append(out, Attr{
+			Type: t &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER),
+			Data: b[unix.SizeofNlAttr:l],
+		})
+		if align(l) >= len(b) {
+			break
+		}
+		b = b[align(l):]
+	}
+	return out, nil
+}
+
+// Encoder builds a sequence of attributes, optionally preceded by a fixed
+// family-specific header.
+type Encoder struct {
+	buf   []byte
+	nests []int
+}
+
+// NewEncoder returns an Encoder whose output begins with header.
+func NewEncoder(header []byte) *Encoder {
+	return &Encoder{buf: pad(append([]byte(nil), header...))}
+}
+
+func (e *Encoder) Bytes(typ uint16, v []byte) {
+	l := unix.SizeofNlAttr + len(v)
+	hdr := make([]byte, unix.SizeofNlAttr)
+	binary.NativeEndian.PutUint16(hdr[0:2], uint16(l))
+	binary.NativeEndian.PutUint16(hdr[2:4], typ)
+	e.buf = pad(append(append(e.buf, hdr...), v...))
+}
+
+func (e *Encoder) Uint8(typ uint16, v uint8) {
+	e.Bytes(typ, []byte{v})
+}
+
+func (e *Encoder) Uint16(typ uint16, v uint16) {
+	b := make([]byte, 2)
+	binary.NativeEndian.PutUint16(b, v)
+	e.Bytes(typ, b)
+}
+
+func (e *Encoder) Uint32(typ uint16, v uint32) {
+	b := make([]byte, 4)
+	binary.NativeEndian.PutUint32(b, v)
+	e.Bytes(typ, b)
+}
+
+// Uint32BE encodes v in network byte order, as nftables expects.
+func (e *Encoder) Uint32BE(typ uint16, v uint32) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	e.Bytes(typ, b)
+}
+
+// String encodes v as a NUL-terminated string.
+func (e *Encoder) String(typ uint16, v string) {
+	e.Bytes(typ, append([]byte(v), 0))
+}
+
+// Nest starts a nested attribute; every Nest must be matched by an End.
+func (e *Encoder) Nest(typ uint16) {
+	e.nests = append(e.nests, len(e.buf))
+	e.Bytes(typ|unix.NLA_F_NESTED, nil)
+}
+
+// End closes the innermost nested attribute.
+func (e *Encoder) End() {
+	start := e.nests[len(e.nests)-1]
+	e.nests = e.nests[:len(e.nests)-1]
+	binary.NativeEndian.PutUint16(e.buf[start:start+2], uint16(len(e.buf)-start))
+}
+
+// Encode returns the encoded header and attributes.
+func (e *Encoder) Encode() []byte {
+	if len(e.nests) != 0 {
+		panic("netlink: unterminated nested attribute")
+	}
+	return e.buf
+}
@@ -0,0 +1,41 @@
+package netlink
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// GenlHeader returns a generic netlink message header.
+func GenlHeader(cmd, version uint8) []byte {
+	return []byte{cmd, version, 0, 0}
+}
+
+// ResolveFamily looks up the id of the named generic netlink family. The
+// connection must be for unix.NETLINK_GENERIC.
+func (c *Conn) ResolveFamily(name string) (uint16, error) {
+	e := NewEncoder(GenlHeader(unix.CTRL_CMD_GETFAMILY, 1))
+	e.String(unix.CTRL_ATTR_FAMILY_NAME, name)
+	msgs, err := c.Execute(unix.GENL_ID_CTRL, 0, e.Encode())
+	if err != nil {
+		if IsNotExist(err) {
+			return 0, fmt.Errorf("generic netlink family %q is not available (is the kernel module loaded?)", name)
+		}
+		return 0, fmt.Errorf("could not resolve generic netlink family %q: %w", name, err)
+	}
+	for _, m := range msgs {
+		if len(m.Data) < unix.GENL_HDRLEN {
+			continue
+		}
+		attrs, err := ParseAttrs(m.Data[unix.GENL_HDRLEN:])
+		if err != nil {
+			return 0, err
+		}
+		for _, a := range attrs {
+			if a.Type == unix.CTRL_ATTR_FAMILY_ID {
+				return a.Uint16(), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("generic netlink family %q: no id in reply", name)
+}
@@ -0,0 +1,218 @@
+// Package netlink is a minimal netlink client, covering just what pia-tools
+// needs to configure links, addresses, routes, WireGuard devices and nftables
+// without shelling out.
+package netlink
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// Conn is a netlink socket for a single protocol family.
+type Conn struct {
+	fd  int
+	seq atomic.Uint32
+}
+
+// Message is a received netlink message; Data excludes the header.
+type Message struct {
+	Header unix.NlMsghdr
+	Data   []byte
+}
+
+// Dial opens a netlink socket for proto, eg unix.NETLINK_ROUTE.
+func Dial(proto int) (*Conn, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	// Extended acks make the kernel explain EINVAL and friends.
+	_ = unix.SetsockoptInt(fd, unix.SOL_NETLINK, unix.NETLINK_EXT_ACK, 1)
+	c := &Conn{fd: fd}
+	c.seq.Store(uint32(os.Getpid()))
+	return c, nil
+}
+
+func (c *Conn) Close() error {
+	return unix.Close(c.fd)
+}
+
+// Encode frames payload as a netlink message with the given type and flags,
+// assigning it the next sequence number.
+func (c *Conn) Encode(typ, flags uint16, payload []byte) ([]byte, uint32) {
+	seq := c.seq.Add(1)
+	b := make([]byte, unix.NLMSG_HDRLEN, unix.NLMSG_HDRLEN+align(len(payload)))
+	binary.NativeEndian.PutUint32(b[0:4], uint32(unix.NLMSG_HDRLEN+len(payload)))
+	binary.NativeEndian.PutUint16(b[4:6], typ)
+	binary.NativeEndian.PutUint16(b[6:8], flags)
+	binary.NativeEndian.PutUint32(b[8:12], seq)
+	b = append(b, payload...)
+	return pad(b), seq
+}
+
+// Execute sends a request and collects the replies until the kernel
+// acknowledges it or finishes a dump. NLM_F_REQUEST and NLM_F_ACK are always
+// set. A negative acknowledgement is returned as an error.
+func (c *Conn) Execute(typ, flags uint16, payload []byte) ([]Message, error) {
+	msg, seq := c.Encode(typ, flags|unix.NLM_F_REQUEST|unix.NLM_F_ACK, payload)
+	if err := c.Send(msg); err != nil {
+		return nil, err
+	}
+	return c.Receive(seq, 1)
+}
+
+// Send writes one or more already-encoded messages in a single datagram.
+func (c *Conn) Send(msgs ...[]byte) error {
+	var b []byte
+	for _, m := range msgs {
+		b = append(b, m...)
+	}
+	if err := unix.Sendto(c.fd, b, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return os.NewSyscallError("sendto", err)
+	}
+	return nil
+}
+
+// Receive reads replies to the requests with sequence numbers
+// [first, first+count) until each has been acknowledged (or, for dumps,
+// finished). The first error reported by the kernel is returned after all
+// outstanding replies have been drained.
+func (c *Conn) Receive(first uint32, count int) ([]Message, error) {
+	var out []Message
+	var firstErr error
+	pending := count
+	buf := make([]byte, 1<<16)
+	for pending > 0 {
+		n, _, err := unix.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			return nil, os.NewSyscallError("recvfrom", err)
+		}
+		// Copy, since returned messages alias the datagram.
+		msgs, err := parseMessages(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq-first >= uint32(count) {
+				continue // stale reply to someone else's request
+			}
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				pending--
+			case unix.NLMSG_ERROR:
+				pending--
+				if err := parseError(m.Header.Flags, m.Data); err != nil && firstErr == nil {
+					firstErr = err
+				}
+			default:
+				// Plain replies are followed by an ack; dump
+				// parts by NLMSG_DONE. Either way, that is
+				// what completes the request.
+				out = append(out, m)
+			}
+		}
+	}
+	return out, firstErr
+}
+
+// Error is a negative acknowledgement from the kernel.
+type Error struct {
+	Errno   unix.Errno
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%v: %s", e.Errno, e.Message)
+	}
+	return e.Errno.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Errno
+}
+
+// IsExist reports whether err is the kernel complaining that an object already
+// exists.
+func IsExist(err error) bool {
+	return errors.Is(err, unix.EEXIST)
+}
+
+// IsNotExist reports whether err is the kernel complaining that an object does
+// not exist.
+func IsNotExist(err error) bool {
+	return errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENODEV) || errors.Is(err, unix.ESRCH)
+}
+
+func parseError(flags uint16, b []byte) error {
+	if len(b) < 4 {
+		return fmt.Errorf("netlink: short error message")
+	}
+	code := int32(binary.NativeEndian.Uint32(b[0:4]))
+	if code == 0 {
+		return nil
+	}
+	e := &Error{Errno: unix.Errno(-code)}
+	// With extended acks, the original request header (and, without
+	// NLM_F_CAPPED, its payload) is followed by attributes, one of which may
+	// be a human-readable message.
+	if flags&unix.NLM_F_ACK_TLVS != 0 && len(b) >= 4+unix.NLMSG_HDRLEN {
+		hlen := int(binary.NativeEndian.Uint32(b[4:8]))
+		off := 4 + unix.NLMSG_HDRLEN
+		if flags&unix.NLM_F_CAPPED == 0 {
+			off = 4 + align(hlen)
+		}
+		if off <= len(b) {
+			if attrs, err := ParseAttrs(b[off:]); err == nil {
+				for _, a := range attrs {
+					if a.Type == unix.NLMSGERR_ATTR_MSG {
+						e.Message = a.String()
+					}
+				}
+			}
+		}
+	}
+	return e
+}
+
+func parseMessages(b []byte) ([]Message, error) {
+	var out []Message
+	for len(b) >= unix.NLMSG_HDRLEN {
+		var h unix.NlMsghdr
+		h.Len = binary.NativeEndian.Uint32(b[0:4])
+		h.Type = binary.NativeEndian.Uint16(b[4:6])
+		h.Flags = binary.NativeEndian.Uint16(b[6:8])
+		h.Seq = binary.NativeEndian.Uint32(b[8:12])
+		h.Pid = binary.NativeEndian.Uint32(b[12:16])
+		if int(h.Len) < unix.NLMSG_HDRLEN || int(h.Len) > len(b) {
+			return nil, fmt.Errorf("netlink: malformed message length %d", h.Len)
+		}
+		out = append(out, Message{Header: h, Data: b[unix.NLMSG_HDRLEN:h.Len]})
+		next := align(int(h.Len))
+		if next > len(b) {
+			break
+		}
+		b = b[next:]
+	}
+	return out, nil
+}
+
+func align(n int) int {
+	return (n + 3) &^ 3
+}
+
+func pad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
@@ -0,0 +1,48 @@
+package netlink
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/sys/unix"
+)
+
+// NfgenHeader returns a netfilter netlink message header (struct nfgenmsg).
+func NfgenHeader(family uint8, resID uint16) []byte {
+	b := []byte{family, unix.NFNETLINK_V0, 0, 0}
+	binary.BigEndian.PutUint16(b[2:4], resID)
+	return b
+}
+
+// BatchMessage is one request within a netfilter transaction.
+type BatchMessage struct {
+	Type    uint16
+	Flags   uint16
+	Payload []byte
+}
+
+// ExecuteBatch sends msgs as a single netfilter transaction for subsystem
+// subsys (eg unix.NFNL_SUBSYS_NFTABLES): the kernel applies all of them or
+// none. The connection must be for unix.NETLINK_NETFILTER. NLM_F_REQUEST and
+// NLM_F_ACK are set on every message, and the first error is returned.
+func (c *Conn) ExecuteBatch(subsys uint16, msgs []BatchMessage) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	begin, _ := c.Encode(unix.NFNL_MSG_BATCH_BEGIN, unix.NLM_F_REQUEST, NfgenHeader(unix.AF_UNSPEC, subsys))
+	out := [][]byte{begin}
+	var first uint32
+	for i, m := range msgs {
+		b, seq := c.Encode(m.Type, m.Flags|unix.NLM_F_REQUEST|unix.NLM_F_ACK, m.Payload)
+		if i == 0 {
+			first = seq
+		}
+		out = append(out, b)
+	}
+	end, _ := c.Encode(unix.NFNL_MSG_BATCH_END, unix.NLM_F_REQUEST, NfgenHeader(unix.AF_UNSPEC, subsys))
+	out = append(out, end)
+	if err := c.Send(out...); err != nil {
+		return err
+	}
+	_, err := c.Receive(first, len(msgs))
+	return err
+}
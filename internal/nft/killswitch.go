@@ -0,0 +1,237 @@
+package nft
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+
+	"github.com/jdelkins/pia-tools/internal/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Verdicts, from linux/netfilter.h.
+const (
+	nfDrop   = 0
+	nfAccept = 1
+)
+
+// DefaultAllowed are the destinations a kill switch allows by default: the
+// private, link-local and multicast ranges, ie the LAN.
+var DefaultAllowed = []netip.Prefix{
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// KillSwitch describes an inet table whose output and forward chains drop
+// anything that would leave other than through the tunnel.
+type KillSwitch struct {
+	// Table is the name of the inet table, which belongs to the kill switch.
+	Table string
+	// Interface is the tunnel's interface; all traffic through it is
+	// allowed.
+	Interface string
+	// Endpoint is the WireGuard server, which is allowed over UDP. Its API
+	// port is also allowed over TCP, so the tunnel can be re-keyed.
+	Endpoint netip.AddrPort
+	APIPort  uint16
+	// DNS servers are allowed whichever way they are routed.
+	DNS []netip.Addr
+	// Allowed are further destinations, eg the LAN.
+	Allowed []netip.Prefix
+	// UID, if not 0, allows local traffic from that user, which lets
+	// pia-tools reach PIA's API to set up a new tunnel. Root can't be
+	// exempted, since so much runs as root.
+	UID int
+}
+
+// InstallKillSwitch replaces the kill switch table (creating it if need be)
+// in a single transaction, so there is no moment without one. Requires
+// CAP_NET_ADMIN.
+func InstallKillSwitch(ks KillSwitch) error {
+	if ks.Table == "" || ks.Interface == "" {
+		return fmt.Errorf("kill switch needs a table and an interface")
+	}
+	if !ks.Endpoint.Addr().Is4() {
+		return fmt.Errorf("kill switch endpoint %s must be an IPv4 address", ks.Endpoint)
+	}
+	c, err := netlink.Dial(unix.NETLINK_NETFILTER)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	o := &Object{Family: "inet", Table: ks.Table}
+	// Creating the table before deleting it means the delete can't fail,
+	// whether or not it existed.
+	msgs := []netlink.BatchMessage{
+		msg(unix.NFT_MSG_NEWTABLE, unix.NLM_F_CREATE, table(o)),
+		msg(unix.NFT_MSG_DELTABLE, 0, table(o)),
+		msg(unix.NFT_MSG_NEWTABLE, unix.NLM_F_CREATE, table(o)),
+	}
+	for _, hook := range []struct {
+		name string
+		num  uint32
+	}{{"output", unix.NF_INET_LOCAL_OUT}, {"forward", unix.NF_INET_FORWARD}} {
+		ch := &Object{Family: "inet", Table: ks.Table, Name: hook.name}
+		msgs = append(msgs, msg(unix.NFT_MSG_NEWCHAIN, unix.NLM_F_CREATE, filterChain(ch, hook.num)))
+		for _, exprs := range ks.rules(hook.num == unix.NF_INET_LOCAL_OUT) {
+			msgs = append(msgs, msg(unix.NFT_MSG_NEWRULE, unix.NLM_F_CREATE|unix.NLM_F_APPEND, rule(ch, exprs)))
+		}
+	}
+	if err := c.ExecuteBatch(unix.NFNL_SUBSYS_NFTABLES, msgs); err != nil {
+		return fmt.Errorf("could not install kill switch: %w", err)
+	}
+	return nil
+}
+
+// rules returns the accept rules of a kill switch chain, like
+//
+//	oifname "lo" accept
+//	oifname "pia" accept
+//	ip daddr 198.51.100.7 udp dport 1337 accept
+//	ip daddr 198.51.100.7 tcp dport 1337 accept
+//	ip daddr 10.0.0.243 accept
+//	ip daddr 192.168.0.0/16 accept
+//	udp sport 68 udp dport 67 accept
+//	udp sport 546 udp dport 547 accept
+//	meta skuid 990 accept
+//
+// The DHCP rules, in the output chain only, let the host keep its leases on
+// the LAN, whose DHCP server may be reached by broadcast or at an address
+// outside Allowed.
+func (ks KillSwitch) rules(output bool) [][]expr {
+	var rules [][]expr
+	if output {
+		rules = append(rules, []expr{meta(unix.NFT_META_OIFNAME), cmpEq(ifname("lo")), verdict(nfAccept)})
+	}
+	rules = append(rules, []expr{meta(unix.NFT_META_OIFNAME), cmpEq(ifname(ks.Interface)), verdict(nfAccept)})
+
+	endpoint := netip.PrefixFrom(ks.Endpoint.Addr(), 32)
+	rules = append(rules, append(daddr(endpoint),
+		meta(unix.NFT_META_L4PROTO), cmpEq([]byte{unix.IPPROTO_UDP}),
+		transportPayload(2, 2), cmpEq(be16(ks.Endpoint.Port())),
+		verdict(nfAccept)))
+	if ks.APIPort != 0 {
+		rules = append(rules, append(daddr(endpoint),
+			meta(unix.NFT_META_L4PROTO), cmpEq([]byte{unix.IPPROTO_TCP}),
+			transportPayload(2, 2), cmpEq(be16(ks.APIPort)),
+			verdict(nfAccept)))
+	}
+	for _, d := range ks.DNS {
+		rules = append(rules, append(daddr(netip.PrefixFrom(d, d.BitLen())), verdict(nfAccept)))
+	}
+	for _, p := range ks.Allowed {
+		rules = append(rules, append(daddr(p.Masked()), verdict(nfAccept)))
+	}
+	if output {
+		for _, ports := range [][2]uint16{{68, 67}, {546, 547}} {
+			rules = append(rules, []expr{
+				meta(unix.NFT_META_L4PROTO), cmpEq([]byte{unix.IPPROTO_UDP}),
+				transportPayload(0, 2), cmpEq(be16(ports[0])),
+				transportPayload(2, 2), cmpEq(be16(ports[1])),
+				verdict(nfAccept),
+			})
+		}
+	}
+	if output && ks.UID != 0 {
+		uid := make([]byte, 4)
+		binary.NativeEndian.PutUint32(uid, uint32(ks.UID))
+		rules = append(rules, []expr{meta(unix.NFT_META_SKUID), cmpEq(uid), verdict(nfAccept)})
+	}
+	return rules
+}
+
+// filterChain describes a chain like
+//
+//	type filter hook output priority filter; policy drop
+func filterChain(o *Object, hook uint32) []byte {
+	e := netlink.NewEncoder(header(o))
+	e.String(unix.NFTA_CHAIN_TABLE, o.Table)
+	e.String(unix.NFTA_CHAIN_NAME, o.Name)
+	e.Nest(unix.NFTA_CHAIN_HOOK)
+	e.Uint32BE(unix.NFTA_HOOK_HOOKNUM, hook)
+	e.Uint32BE(unix.NFTA_HOOK_PRIORITY, 0)
+	e.End()
+	e.String(unix.NFTA_CHAIN_TYPE, "filter")
+	e.Uint32BE(unix.NFTA_CHAIN_POLICY, nfDrop)
+	return e.Encode()
+}
+
+// ifname pads an interface name as the kernel compares them: IFNAMSIZ
+// bytes, NUL-padded.
+func ifname(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
+
+// daddr matches packets whose destination address is within p.
+func daddr(p netip.Prefix) []expr {
+	proto, offset := uint8(unix.NFPROTO_IPV4), uint32(16)
+	if p.Addr().Is6() {
+		proto, offset = unix.NFPROTO_IPV6, 24
+	}
+	addr := p.Addr().AsSlice()
+	exprs := []expr{
+		meta(unix.NFT_META_NFPROTO), cmpEq([]byte{proto}),
+		networkPayload(offset, uint32(len(addr))),
+	}
+	if p.Bits() < len(addr)*8 {
+		mask := netip.PrefixFrom(netip.IPv6Unspecified(), p.Bits())
+		if p.Addr().Is4() {
+			mask = netip.PrefixFrom(netip.IPv4Unspecified(), p.Bits())
+		}
+		exprs = append(exprs, bitwiseAnd(prefixMask(mask)))
+	}
+	return append(exprs, cmpEq(addr))
+}
+
+func prefixMask(p netip.Prefix) []byte {
+	b := make([]byte, p.Addr().BitLen()/8)
+	for i := 0; i < p.Bits(); i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	return b
+}
+
+// networkPayload loads bytes from the network header into register 1.
+func networkPayload(offset, length uint32) expr {
+	return expr{"payload", func(e *netlink.Encoder) {
+		e.Uint32BE(unix.NFTA_PAYLOAD_DREG, unix.NFT_REG_1)
+		e.Uint32BE(unix.NFTA_PAYLOAD_BASE, unix.NFT_PAYLOAD_NETWORK_HEADER)
+		e.Uint32BE(unix.NFTA_PAYLOAD_OFFSET, offset)
+		e.Uint32BE(unix.NFTA_PAYLOAD_LEN, length)
+	}}
+}
+
+// bitwiseAnd masks register 1 with mask.
+func bitwiseAnd(mask []byte) expr {
+	return expr{"bitwise", func(e *netlink.Encoder) {
+		e.Uint32BE(unix.NFTA_BITWISE_SREG, unix.NFT_REG_1)
+		e.Uint32BE(unix.NFTA_BITWISE_DREG, unix.NFT_REG_1)
+		e.Uint32BE(unix.NFTA_BITWISE_LEN, uint32(len(mask)))
+		e.Nest(unix.NFTA_BITWISE_MASK)
+		e.Bytes(unix.NFTA_DATA_VALUE, mask)
+		e.End()
+		e.Nest(unix.NFTA_BITWISE_XOR)
+		e.Bytes(unix.NFTA_DATA_VALUE, make([]byte, len(mask)))
+		e.End()
+	}}
+}
+
+func verdict(code uint32) expr {
+	return expr{"immediate", func(e *netlink.Encoder) {
+		e.Uint32BE(unix.NFTA_IMMEDIATE_DREG, unix.NFT_REG_VERDICT)
+		e.Nest(unix.NFTA_IMMEDIATE_DATA)
+		e.Nest(unix.NFTA_DATA_VERDICT)
+		e.Uint32BE(unix.NFTA_VERDICT_CODE, code)
+		e.End()
+		e.End()
+	}}
+}
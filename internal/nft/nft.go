@@ -0,0 +1,297 @@
+// Package nft keeps nftables in step with the forwarded port and the tunnel,
+// by talking netlink to the kernel rather than running nft(8).
+package nft
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/jdelkins/pia-tools/internal/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Object names a table-scoped nftables object, a set or a chain, as in
+// "inet filter pia_ports".
+type Object struct {
+	Family string
+	Table  string
+	Name   string
+}
+
+var families = map[string]uint8{
+	"ip":     unix.NFPROTO_IPV4,
+	"ip6":    unix.NFPROTO_IPV6,
+	"inet":   unix.NFPROTO_INET,
+	"arp":    unix.NFPROTO_ARP,
+	"bridge": unix.NFPROTO_BRIDGE,
+	"netdev": unix.NFPROTO_NETDEV,
+}
+
+// UnmarshalText parses "family table name", with the words separated by
+// spaces or commas.
+func (o *Object) UnmarshalText(text []byte) error {
+	f := strings.FieldsFunc(string(text), func(r rune) bool { return r == ' ' || r == ',' })
+	if len(f) != 3 {
+		return fmt.Errorf("%q: expected family, table and name, eg \"inet filter pia_ports\"", text)
+	}
+	if _, ok := families[f[0]]; !ok {
+		return fmt.Errorf("%q: unknown nftables family %q", text, f[0])
+	}
+	*o = Object{Family: f[0], Table: f[1], Name: f[2]}
+	return nil
+}
+
+func (o Object) String() string {
+	return o.Family + " " + o.Table + " " + o.Name
+}
+
+// Config describes what Update maintains.
+type Config struct {
+	// Set, if not nil, names an existing set of inet_service whose only
+	// element will be the forwarded port.
+	Set *Object
+
+	// DNATChain, if not nil, names a chain whose only rules will DNAT TCP
+	// and UDP traffic for the forwarded port to DNATTo. The chain (and its
+	// table) is created as a prerouting nat chain if it does not exist.
+	DNATChain *Object
+	// DNATTo is the internal host to forward to. If its port is 0, the
+	// forwarded port is kept.
+	DNATTo netip.AddrPort
+	// Interface, if not empty, restricts the DNAT rules to traffic arriving
+	// on it, ie the tunnel.
+	Interface string
+}
+
+// Update replaces the port in the configured set and the DNAT rules in the
+// configured chain with port, in a single transaction. Requires
+// CAP_NET_ADMIN.
+func Update(port int, cfg Config) error {
+	if cfg.Set == nil && cfg.DNATChain == nil {
+		return nil
+	}
+	if ch := cfg.DNATChain; ch != nil {
+		if ch.Family != "ip" && ch.Family != "inet" {
+			return fmt.Errorf("DNAT chain %s must be in an ip or inet table", ch)
+		}
+		if !cfg.DNATTo.Addr().Is4() {
+			return fmt.Errorf("DNAT target %s must be an IPv4 address", cfg.DNATTo)
+		}
+	}
+	c, err := netlink.Dial(unix.NETLINK_NETFILTER)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	var msgs []netlink.BatchMessage
+	if s := cfg.Set; s != nil {
+		msgs = append(msgs,
+			// without elements, this flushes the set
+			msg(unix.NFT_MSG_DELSETELEM, 0, setElems(s, nil)),
+			msg(unix.NFT_MSG_NEWSETELEM, unix.NLM_F_CREATE, setElems(s, []uint16{uint16(port)})),
+		)
+	}
+	if ch := cfg.DNATChain; ch != nil {
+		exists, err := chainExists(c, ch)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			msgs = append(msgs,
+				msg(unix.NFT_MSG_NEWTABLE, unix.NLM_F_CREATE, table(ch)),
+				msg(unix.NFT_MSG_NEWCHAIN, unix.NLM_F_CREATE, natChain(ch)),
+			)
+		}
+		// without a handle, this flushes the chain
+		msgs = append(msgs, msg(unix.NFT_MSG_DELRULE, 0, rule(ch, nil)))
+		to := cfg.DNATTo
+		if to.Port() == 0 {
+			to = netip.AddrPortFrom(to.Addr(), uint16(port))
+		}
+		for _, proto := range []uint8{unix.IPPROTO_TCP, unix.IPPROTO_UDP} {
+			exprs := dnatExprs(ch.Family, cfg.Interface, proto, uint16(port), to)
+			msgs = append(msgs, msg(unix.NFT_MSG_NEWRULE, unix.NLM_F_CREATE|unix.NLM_F_APPEND, rule(ch, exprs)))
+		}
+	}
+
+	if err := c.ExecuteBatch(unix.NFNL_SUBSYS_NFTABLES, msgs); err != nil {
+		if netlink.IsNotExist(err) && cfg.Set != nil {
+			return fmt.Errorf("could not update nftables (does set %s exist?): %w", cfg.Set, err)
+		}
+		return fmt.Errorf("could not update nftables: %w", err)
+	}
+	return nil
+}
+
+func msg(typ uint16, flags uint16, payload []byte) netlink.BatchMessage {
+	return netlink.BatchMessage{
+		Type:    unix.NFNL_SUBSYS_NFTABLES<<8 | typ,
+		Flags:   flags,
+		Payload: payload,
+	}
+}
+
+func header(o *Object) []byte {
+	return netlink.NfgenHeader(families[o.Family], 0)
+}
+
+func setElems(s *Object, ports []uint16) []byte {
+	e := netlink.NewEncoder(header(s))
+	e.String(unix.NFTA_SET_ELEM_LIST_TABLE, s.Table)
+	e.String(unix.NFTA_SET_ELEM_LIST_SET, s.Name)
+	if len(ports) > 0 {
+		e.Nest(unix.NFTA_SET_ELEM_LIST_ELEMENTS)
+		for _, p := range ports {
+			e.Nest(unix.NFTA_LIST_ELEM)
+			e.Nest(unix.NFTA_SET_ELEM_KEY)
+			e.Bytes(unix.NFTA_DATA_VALUE, be16(p))
+			e.End()
+			e.End()
+		}
+		e.End()
+	}
+	return e.Encode()
+}
+
+func table(o *Object) []byte {
+	e := netlink.NewEncoder(header(o))
+	e.String(unix.NFTA_TABLE_NAME, o.Table)
+	return e.Encode()
+}
+
+// natChain describes a chain like
+//
+//	type nat hook prerouting priority dstnat
+func natChain(o *Object) []byte {
+	const dstnat = -100
+	e := netlink.NewEncoder(header(o))
+	e.String(unix.NFTA_CHAIN_TABLE, o.Table)
+	e.String(unix.NFTA_CHAIN_NAME, o.Name)
+	e.Nest(unix.NFTA_CHAIN_HOOK)
+	e.Uint32BE(unix.NFTA_HOOK_HOOKNUM, unix.NF_INET_PRE_ROUTING)
+	p := int32(dstnat)
+	e.Uint32BE(unix.NFTA_HOOK_PRIORITY, uint32(p))
+	e.End()
+	e.String(unix.NFTA_CHAIN_TYPE, "nat")
+	return e.Encode()
+}
+
+func chainExists(c *netlink.Conn, o *Object) (bool, error) {
+	e := netlink.NewEncoder(header(o))
+	e.String(unix.NFTA_CHAIN_TABLE, o.Table)
+	e.String(unix.NFTA_CHAIN_NAME, o.Name)
+	_, err := c.Execute(unix.NFNL_SUBSYS_NFTABLES<<8|unix.NFT_MSG_GETCHAIN, 0, e.Encode())
+	if err == nil {
+		return true, nil
+	}
+	if netlink.IsNotExist(err) {
+		return false, nil
+	}
+	return false, fmt.Errorf("could not look up chain %s: %w", o, err)
+}
+
+// expr is one nftables expression: its name, and a function encoding its
+// attributes.
+type expr struct {
+	name string
+	data func(e *netlink.Encoder)
+}
+
+func rule(o *Object, exprs []expr) []byte {
+	e := netlink.NewEncoder(header(o))
+	e.String(unix.NFTA_RULE_TABLE, o.Table)
+	e.String(unix.NFTA_RULE_CHAIN, o.Name)
+	if len(exprs) > 0 {
+		e.Nest(unix.NFTA_RULE_EXPRESSIONS)
+		for _, x := range exprs {
+			e.Nest(unix.NFTA_LIST_ELEM)
+			e.String(unix.NFTA_EXPR_NAME, x.name)
+			e.Nest(unix.NFTA_EXPR_DATA)
+			x.data(e)
+			e.End()
+			e.End()
+		}
+		e.End()
+	}
+	return e.Encode()
+}
+
+// dnatExprs builds the equivalent of
+//
+//	iifname "pia" meta l4proto tcp th dport 12345 dnat ip to 192.168.1.10:12345
+//
+// preceded, in an inet table, by meta nfproto ipv4, so that IPv6 packets are
+// not given an IPv4 address.
+func dnatExprs(family, iif string, proto uint8, port uint16, to netip.AddrPort) []expr {
+	var exprs []expr
+	if family == "inet" {
+		exprs = append(exprs, meta(unix.NFT_META_NFPROTO), cmpEq([]byte{unix.NFPROTO_IPV4}))
+	}
+	if iif != "" {
+		exprs = append(exprs, meta(unix.NFT_META_IIFNAME), cmpEq(ifname(iif)))
+	}
+	addr := to.Addr().As4()
+	exprs = append(exprs,
+		meta(unix.NFT_META_L4PROTO), cmpEq([]byte{proto}),
+		transportPayload(2, 2), cmpEq(be16(port)),
+		immediate(unix.NFT_REG_1, addr[:]),
+		immediate(unix.NFT_REG_2, be16(to.Port())),
+		expr{"nat", func(e *netlink.Encoder) {
+			e.Uint32BE(unix.NFTA_NAT_TYPE, unix.NFT_NAT_DNAT)
+			e.Uint32BE(unix.NFTA_NAT_FAMILY, unix.NFPROTO_IPV4)
+			e.Uint32BE(unix.NFTA_NAT_REG_ADDR_MIN, unix.NFT_REG_1)
+			e.Uint32BE(unix.NFTA_NAT_REG_PROTO_MIN, unix.NFT_REG_2)
+			// Without this, the kernel ignores the port register and
+			// keeps the original port.
+			e.Uint32BE(unix.NFTA_NAT_FLAGS, unix.NF_NAT_RANGE_PROTO_SPECIFIED)
+		}},
+	)
+	return exprs
+}
+
+// meta loads a packet's metadata into register 1.
+func meta(key uint32) expr {
+	return expr{"meta", func(e *netlink.Encoder) {
+		e.Uint32BE(unix.NFTA_META_KEY, key)
+		e.Uint32BE(unix.NFTA_META_DREG, unix.NFT_REG_1)
+	}}
+}
+
+// transportPayload loads bytes from the transport header into register 1.
+func transportPayload(offset, length uint32) expr {
+	return expr{"payload", func(e *netlink.Encoder) {
+		e.Uint32BE(unix.NFTA_PAYLOAD_DREG, unix.NFT_REG_1)
+		e.Uint32BE(unix.NFTA_PAYLOAD_BASE, unix.NFT_PAYLOAD_TRANSPORT_HEADER)
+		e.Uint32BE(unix.NFTA_PAYLOAD_OFFSET, offset)
+		e.Uint32BE(unix.NFTA_PAYLOAD_LEN, length)
+	}}
+}
+
+// cmpEq breaks out of the rule unless register 1 equals v.
+func cmpEq(v []byte) expr {
+	return expr{"cmp", func(e *netlink.Encoder) {
+		e.Uint32BE(unix.NFTA_CMP_SREG, unix.NFT_REG_1)
+		e.Uint32BE(unix.NFTA_CMP_OP, unix.NFT_CMP_EQ)
+		e.Nest(unix.NFTA_CMP_DATA)
+		e.Bytes(unix.NFTA_DATA_VALUE, v)
+		e.End()
+	}}
+}
+
+func immediate(reg uint32, v []byte) expr {
+	return expr{"immediate", func(e *netlink.Encoder) {
+		e.Uint32BE(unix.NFTA_IMMEDIATE_DREG, reg)
+		e.Nest(unix.NFTA_IMMEDIATE_DATA)
+		e.Bytes(unix.NFTA_DATA_VALUE, v)
+		e.End()
+	}}
+}
+
+func be16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
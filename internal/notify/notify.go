@@ -0,0 +1,197 @@
+// Package notify tells torrent clients which port PIA has forwarded to us.
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jdelkins/pia-tools/internal/deluge"
+	"github.com/jdelkins/pia-tools/internal/qbittorrent"
+	"github.com/jdelkins/pia-tools/internal/rtorrent"
+	"github.com/jdelkins/pia-tools/internal/transmission"
+)
+
+// Notifier is a client that listens on the forwarded port.
+type Notifier interface {
+	// Name identifies the client in messages, eg "transmission at
+	// http://localhost:9091/transmission/rpc". It must not include
+	// credentials.
+	Name() string
+	// SetPort makes the client listen on port.
+	SetPort(ctx context.Context, port int) error
+	// CurrentPort returns the port the client is configured to listen on.
+	CurrentPort(ctx context.Context) (int, error)
+}
+
+// Factory builds a Notifier from a URL whose scheme has had the notifier's
+// name and "+" stripped, eg https://user:pw@host:9091/rpc for
+// transmission+https://user:pw@host:9091/rpc.
+type Factory func(u *url.URL) (Notifier, error)
+
+var (
+	mu        sync.Mutex
+	factories = map[string]Factory{}
+)
+
+// Register makes a Factory available to Parse under name, which is used as
+// the scheme prefix of notifier URLs. It panics if name is already taken.
+func Register(name string, f Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := factories[name]; ok {
+		panic("notify: Register called twice for " + name)
+	}
+	factories[name] = f
+}
+
+// Names returns the registered notifier names, sorted.
+func Names() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	names := make([]string, 0, len(factories))
+	for n := range factories {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Parse builds a Notifier from a URL of the form name+scheme://..., eg
+// rtorrent+http://localhost:5000.
+func Parse(spec string) (Notifier, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	name, scheme, ok := strings.Cut(u.Scheme, "+")
+	if !ok {
+		return nil, fmt.Errorf("notifier URL %q must begin with one of %s, followed by +http:// or +https://", u.Redacted(), strings.Join(Names(), ", "))
+	}
+	mu.Lock()
+	f, ok := factories[name]
+	mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown notifier %q in %q; known notifiers are %s", name, u.Redacted(), strings.Join(Names(), ", "))
+	}
+	if scheme != "http" && scheme != "https" {
+		return nil, fmt.Errorf("notifier URL %q must use http or https", u.Redacted())
+	}
+	u.Scheme = scheme
+	return f(u)
+}
+
+// Set tells n to listen on port, then checks that it took. Each of the two
+// calls to n is given at most timeout, if it is positive, so that a client
+// that hangs cannot hold up the caller indefinitely.
+func Set(ctx context.Context, n Notifier, port int, timeout time.Duration) error {
+	if err := withTimeout(ctx, timeout, func(ctx context.Context) error {
+		return n.SetPort(ctx, port)
+	}); err != nil {
+		return fmt.Errorf("could not notify %s of assigned port: %w", n.Name(), err)
+	}
+	var got int
+	if err := withTimeout(ctx, timeout, func(ctx context.Context) (err error) {
+		got, err = n.CurrentPort(ctx)
+		return err
+	}); err != nil {
+		return fmt.Errorf("could not verify port of %s: %w", n.Name(), err)
+	}
+	if got != port {
+		return fmt.Errorf("PIA assigned us port %d, but %s reports port is %d", port, n.Name(), got)
+	}
+	return nil
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration, f func(context.Context) error) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return f(ctx)
+}
+
+// Result is the outcome of notifying one client.
+type Result struct {
+	Notifier Notifier
+	Err      error
+}
+
+// SetAll calls Set for each notifier in turn, carrying on past failures.
+func SetAll(ctx context.Context, ns []Notifier, port int, timeout time.Duration) []Result {
+	results := make([]Result, len(ns))
+	for i, n := range ns {
+		results[i] = Result{Notifier: n, Err: Set(ctx, n, port, timeout)}
+	}
+	return results
+}
+
+func init() {
+	Register("rtorrent", func(u *url.URL) (Notifier, error) {
+		return Named("rtorrent", u.String(), &rtorrent.Client{URL: u.String()}), nil
+	})
+	Register("transmission", func(u *url.URL) (Notifier, error) {
+		user, pass := credentials(u)
+		return Named("transmission", u.String(), &transmission.Client{URL: u.String(), Username: user, Password: pass}), nil
+	})
+	Register("qbittorrent", func(u *url.URL) (Notifier, error) {
+		user, pass := credentials(u)
+		// The CA file is given as a query parameter, eg ?ca=/etc/ssl/qb.pem
+		q := u.Query()
+		ca := q.Get("ca")
+		q.Del("ca")
+		u.RawQuery = q.Encode()
+		return Named("qbittorrent", u.String(), &qbittorrent.Client{URL: u.String(), Username: user, Password: pass, CAFile: ca}), nil
+	})
+	Register("deluge", func(u *url.URL) (Notifier, error) {
+		// deluge-web has no usernames, so accept either deluge+http://:pw@host
+		// or deluge+http://pw@host.
+		user, pass := credentials(u)
+		if pass == "" {
+			pass = user
+		}
+		return Named("deluge", u.String(), &deluge.Client{URL: u.String(), Password: pass}), nil
+	})
+}
+
+// Client is implemented by each of the torrent client packages, which leave
+// naming to Named.
+type Client interface {
+	SetPort(ctx context.Context, port int) error
+	CurrentPort(ctx context.Context) (int, error)
+}
+
+type named struct {
+	Client
+	name string
+}
+
+func (n named) Name() string {
+	return n.name
+}
+
+// Named returns c as a Notifier named for kind and rawURL, where c is
+// reached. The URL may carry credentials, eg for basic auth, so they are
+// redacted.
+func Named(kind, rawURL string, c Client) Notifier {
+	if u, err := url.Parse(rawURL); err == nil {
+		return named{c, kind + " at " + u.Redacted()}
+	}
+	return named{c, kind}
+}
+
+// credentials removes and returns the user info from u.
+func credentials(u *url.URL) (username, password string) {
+	if u.User == nil {
+		return "", ""
+	}
+	username = u.User.Username()
+	password, _ = u.User.Password()
+	u.User = nil
+	return username, password
+}
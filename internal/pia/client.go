@@ -0,0 +1,271 @@
+package pia
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	DefaultServerlistURL = "https://serverlist.piaservers.net/vpninfo/servers/v4"
+	DefaultTokenURL      = "https://www.privateinternetaccess.com/api/client/v2/token"
+	DefaultWgAPIPort     = 1337
+	DefaultPFAPIPort     = 19999
+	DefaultMetaPort      = 443
+	DefaultUserAgent     = "pia-tools"
+	DefaultTimeout       = 30 * time.Second
+	DefaultAttempts      = 3
+	DefaultBackoff       = 2 * time.Second
+	DefaultMaxBackoff    = 30 * time.Second
+	DefaultProbeCount    = 3
+	DefaultProbeTimeout  = 1 * time.Second
+	DefaultParallel      = 16
+)
+
+// Client holds everything needed to talk to PIA's API: the HTTP client, the
+// endpoint base URLs, and the CA pool used to verify PIA's own servers. The
+// zero value is usable and behaves like DefaultClient.
+type Client struct {
+	// HTTPClient is used for all requests. Its Transport, if an
+	// *http.Transport, is cloned for requests to PIA's WireGuard servers so
+	// that proxy and dialer settings carry over; only the TLS config is
+	// replaced. Nil means http.DefaultClient.
+	HTTPClient *http.Client
+
+	// ServerlistURL and TokenURL are the public (WebPKI) endpoints.
+	ServerlistURL string
+	TokenURL      string
+
+	// WgAPIPort and PFAPIPort are the ports on which the WireGuard server
+	// answers addKey and getSignature/bindPort respectively, and MetaPort
+	// the port on which a region's meta server answers HTTPS.
+	WgAPIPort int
+	PFAPIPort int
+	MetaPort  int
+
+	// RootCAs verifies PIA's WireGuard servers, which present certificates
+	// signed by PIA's private CA. Nil means the embedded PIA CA.
+	RootCAs *x509.CertPool
+
+	// ServerlistKey verifies the signature appended to the serverlist. Nil
+	// means PIA's embedded key. InsecureServerlist skips the check, which
+	// leaves the choice of WireGuard server to anyone able to tamper with
+	// the serverlist.
+	ServerlistKey      *rsa.PublicKey
+	InsecureServerlist bool
+
+	// ServerlistCacheDir, if set, is where the serverlist is cached between
+	// runs. A cached copy younger than ServerlistMaxAge is used without
+	// asking PIA; an older one is revalidated, and used anyway if the
+	// serverlist can't be fetched.
+	ServerlistCacheDir string
+	ServerlistMaxAge   time.Duration
+
+	UserAgent string
+
+	// Timeout bounds each individual request, including reading the
+	// response body, unless HTTPClient sets its own Timeout. Zero means
+	// DefaultTimeout; negative means no limit beyond the caller's context.
+	Timeout time.Duration
+
+	// Retry governs how Activate retries across a region's servers.
+	Retry RetryPolicy
+
+	// Prober measures the latency to regions and servers. Nil means
+	// unprivileged ICMP with DefaultProbeCount and DefaultProbeTimeout.
+	// ProbeRegions probes Parallel regions at a time (zero means
+	// DefaultParallel), and gives up on those not yet probed once
+	// ProbeDeadline has passed (zero means no deadline beyond the caller's
+	// context).
+	Prober        Prober
+	Parallel      int
+	ProbeDeadline time.Duration
+}
+
+// RetryPolicy describes exponential backoff between rounds of attempts. Zero
+// fields take the corresponding Default value.
+type RetryPolicy struct {
+	// Attempts is the number of passes made over the server list.
+	Attempts int
+	// Backoff is the pause after the first failed pass; it doubles after
+	// each subsequent pass, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+func (r RetryPolicy) attempts() int {
+	if r.Attempts > 0 {
+		return r.Attempts
+	}
+	return DefaultAttempts
+}
+
+// backoff returns the pause to take after the given (zero-based) failed pass.
+func (r RetryPolicy) backoff(pass int) time.Duration {
+	d, max := r.Backoff, r.MaxBackoff
+	if d <= 0 {
+		d = DefaultBackoff
+	}
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+	for ; pass > 0 && d < max; pass-- {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// DefaultClient is used by the package-level functions and the Tunnel methods.
+var DefaultClient = &Client{}
+
+func (c *Client) httpClient() *http.Client {
+	base := http.DefaultClient
+	if c.HTTPClient != nil {
+		base = c.HTTPClient
+	}
+	hc := *base
+	if hc.Timeout == 0 {
+		hc.Timeout = c.timeout()
+	}
+	return &hc
+}
+
+func (c *Client) timeout() time.Duration {
+	switch {
+	case c.Timeout > 0:
+		return c.Timeout
+	case c.Timeout < 0:
+		return 0
+	}
+	return DefaultTimeout
+}
+
+func (c *Client) serverlistURL() string {
+	if c.ServerlistURL != "" {
+		return c.ServerlistURL
+	}
+	return DefaultServerlistURL
+}
+
+func (c *Client) tokenURL() string {
+	if c.TokenURL != "" {
+		return c.TokenURL
+	}
+	return DefaultTokenURL
+}
+
+func (c *Client) wgAPIPort() int {
+	if c.WgAPIPort != 0 {
+		return c.WgAPIPort
+	}
+	return DefaultWgAPIPort
+}
+
+func (c *Client) pfAPIPort() int {
+	if c.PFAPIPort != 0 {
+		return c.PFAPIPort
+	}
+	return DefaultPFAPIPort
+}
+
+func (c *Client) metaPort() int {
+	if c.MetaPort != 0 {
+		return c.MetaPort
+	}
+	return DefaultMetaPort
+}
+
+func (c *Client) serverlistKey() *rsa.PublicKey {
+	if c.ServerlistKey != nil {
+		return c.ServerlistKey
+	}
+	return getPiaServerlistKey()
+}
+
+func (c *Client) rootCAs() *x509.CertPool {
+	if c.RootCAs != nil {
+		return c.RootCAs
+	}
+	return getPiaCertpool()
+}
+
+// do sends a request to a public endpoint.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	c.setHeaders(req)
+	resp, err := c.httpClient().Do(req)
+	return resp, redact(err)
+}
+
+// doPinned sends a request to one of PIA's WireGuard or meta servers, which are
+// addressed by IP and must present a certificate for server_name signed by
+// RootCAs.
+func (c *Client) doPinned(req *http.Request, server_name string) (*http.Response, error) {
+	hc := c.httpClient()
+	tr, ok := hc.Transport.(*http.Transport)
+	if !ok || tr == nil {
+		tr = http.DefaultTransport.(*http.Transport)
+	}
+	tr = tr.Clone()
+	tr.TLSClientConfig = &tls.Config{
+		ServerName: server_name,
+		RootCAs:    c.rootCAs(),
+	}
+	hc.Transport = tr
+	c.setHeaders(req)
+	resp, err := hc.Do(req)
+	return resp, redact(err)
+}
+
+func (c *Client) setHeaders(req *http.Request) {
+	ua := c.UserAgent
+	if ua == "" {
+		ua = DefaultUserAgent
+	}
+	req.Header.Set("User-Agent", ua)
+}
+
+// redact strips the query string, which carries tokens and signatures, from
+// the URL reported in a request error, since these errors end up in logs.
+func redact(err error) error {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		if u, perr := url.Parse(ue.URL); perr == nil && u.RawQuery != "" {
+			u.RawQuery = "…"
+			ue.URL = u.String()
+		}
+	}
+	return err
+}
+
+// timeoutErr makes a timed-out request recognizable as such, rather than
+// leaving the caller with a bare "context deadline exceeded". The query string
+// is deliberately left out of the message since it carries credentials.
+func timeoutErr(req *http.Request, err error) error {
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		return fmt.Errorf("timed out waiting for %s%s: %w", req.URL.Host, req.URL.Path, err)
+	}
+	return err
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,63 @@
+package pia
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// Filter selects regions, eg for automatic region selection.
+type Filter struct {
+	// PortForward, WireGuard and Online require regions to support port
+	// forwarding, to have a WireGuard server, and not to be marked offline.
+	PortForward bool
+	WireGuard   bool
+	Online      bool
+
+	// Countries, if not empty, are the countries, by ISO code, to which
+	// regions are limited; ExcludeCountries and Exclude rule out countries
+	// and region ids respectively. Case is ignored.
+	Countries        []string
+	ExcludeCountries []string
+	Exclude          []string
+
+	// MaxPing, if set, is the longest acceptable ping time. Regions not
+	// pinged are excluded too.
+	MaxPing time.Duration
+}
+
+// Match reports whether r passes the filter. The ping time is only
+// considered if MaxPing is set, so r must have been pinged.
+func (f Filter) Match(r *Region) bool {
+	fold := func(list []string, s string) bool {
+		return slices.ContainsFunc(list, func(v string) bool { return strings.EqualFold(v, s) })
+	}
+	switch {
+	case f.PortForward && !r.PortForward:
+		return false
+	case f.WireGuard && !r.HasWg():
+		return false
+	case f.Online && r.Offline:
+		return false
+	case len(f.Countries) > 0 && !fold(f.Countries, r.Country):
+		return false
+	case fold(f.ExcludeCountries, r.Country):
+		return false
+	case fold(f.Exclude, r.Id):
+		return false
+	case f.MaxPing > 0 && (r.PingTime == 0 || r.PingTime > f.MaxPing):
+		return false
+	}
+	return true
+}
+
+// Apply returns the regions that pass the filter, in their original order.
+func (f Filter) Apply(regions []Region) []Region {
+	var out []Region
+	for i := range regions {
+		if f.Match(&regions[i]) {
+			out = append(out, regions[i])
+		}
+	}
+	return out
+}
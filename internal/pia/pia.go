@@ -1,18 +1,24 @@
 package pia
 
 import (
-	"crypto/tls"
+	"context"
+	"crypto/rsa"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
 )
 
 type Server struct {
 	Ip string `json:"ip"`
 	Cn string `json:"cn"`
+	// Van is the serverlist's "van" flag, which is only given for OpenVPN
+	// servers.
+	Van bool `json:"van,omitempty"`
 }
 
 type Tunnel struct {
@@ -30,12 +36,37 @@ type Tunnel struct {
 	Message      string         `json:"message"`
 	Interface    string         `json:"interface"`
 	PFSig        PortForwardSig `json:",omitempty"`
+	Server       Server         `json:"server"`
+	// Selection says why the region was chosen, if it was chosen
+	// automatically.
+	Selection *Selection `json:"selection,omitempty"`
+	// EndpointRoute is the route to ServerIp that wglink.Apply added
+	// outside the tunnel, if any, so that it can be removed once the
+	// tunnel moves to another server.
+	EndpointRoute *HostRoute `json:"endpoint_route,omitempty"`
+}
+
+// HostRoute is a route to a single address in a given routing table.
+type HostRoute struct {
+	Dst    string `json:"dst"`
+	Table  uint32 `json:"table"`
+	Metric uint32 `json:"metric,omitempty"`
 }
 
 func NewTunnel(region *Region, intf string) *Tunnel {
 	return &Tunnel{Region: *region, Interface: intf}
 }
 
+// WgServer returns the WireGuard server the tunnel was activated with, falling
+// back to the region's first server for caches written before that was
+// recorded.
+func (tun *Tunnel) WgServer() *Server {
+	if tun.Server.Ip != "" {
+		return &tun.Server
+	}
+	return tun.Region.WgServer()
+}
+
 var _piaCertpool *x509.CertPool = nil
 
 func getPiaCertpool() *x509.CertPool {
@@ -95,21 +126,78 @@ iyd1Fzx0yujuiXDROLhISLQDRjVVAvawrAtLZWYK31bY7KlezPlQnl/D9Asxe85l
 	return _piaCertpool
 }
 
-func doRequest(req *http.Request, server_name string) (*http.Response, error) {
-	c := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				ServerName: server_name,
-				RootCAs:    getPiaCertpool(),
-			},
-		},
+var _piaServerlistKey *rsa.PublicKey = nil
+
+func getPiaServerlistKey() *rsa.PublicKey {
+	if _piaServerlistKey == nil {
+		// This is the key with which PIA signs the v4 serverlist, as
+		// embedded in PIA's desktop client.
+		p, _ := pem.Decode([]byte(`
+-----BEGIN PUBLIC KEY-----
+MIICIjANBgkqhkiG9w0BAQEFAAOCAg8AMIICCgKCAgEAzLYHwX5Ug/oUObZ5eH5P
+rEwmfj4E/YEfSKLgFSsyRGGsVmmjiXBmSbX2s3xbj/ofuvYtkMkP/VPFHy9E/8ox
+Y+cRjPzydxz46LPY7jpEw1NHZjOyTeUero5e1nkLhiQqO/cMVYmUnuVcuFfZyZvc
+8Apx5fBrIp2oWpF/G9tpUZfUUJaaHiXDtuYP8o8VhYtyjuUu3h7rkQFoMxvuoOFH
+6nkc0VQmBsHvCfq4T9v8gyiBtQRy543leapTBMT34mxVIQ4ReGLPVit/6sNLoGLb
+gSnGe9Bk/a5V/5vlqeemWF0hgoRtUxMtU1hFbe7e8tSq1j+mu0SHMyKHiHd+OsmU
+IQyFZ3AW6s+H9zAqMwHfPpWeM7hCc0Wa3S7M5CKEF5vQ5/GgqaqsbPZ6GvXPOSNj
+iu4GudIJJ3zqBPQ3Ai5RG+Bkt2YR5BSHqTDWZq2d1JH6dmTHt8sfYNE3Vcg1AupC
+GeOi0YPZYV6ssCrFLMT9qO7qnN+3/CMQfvtBGPQNOOLbjwCGsOBOgvW1xUBNRvpW
+cqkTuYPQbnq1HnCSNsqfJJx3k6KYoVgkvg6NUYmnSnBsk4lCbSsSuj8AxNiHYO6a
+vIiowFAOU+JDrE6avoL2ps5YPNS1Y5LXh6tpoSoq3pjumpYcxbqsOuXiOQKBbqu5
+YgKpcJ/cfEqFIq0vHAsdVvMCAwEAAQ==
+-----END PUBLIC KEY-----
+		`))
+		key, _ := x509.ParsePKIXPublicKey(p.Bytes)
+		_piaServerlistKey = key.(*rsa.PublicKey)
 	}
-	return c.Do(req)
+	return _piaServerlistKey
 }
 
 func (tun *Tunnel) Activate() error {
-	url := fmt.Sprintf("https://%s:1337/addKey", tun.Region.WgServer().Ip)
-	req, err := http.NewRequest("GET", url, nil)
+	return tun.ActivateContext(context.Background())
+}
+
+func (tun *Tunnel) ActivateContext(ctx context.Context) error {
+	return DefaultClient.Activate(ctx, tun)
+}
+
+// Activate registers tun's public key with one of the region's WireGuard
+// servers and fills in the server-assigned tunnel parameters. Servers are tried
+// in the order given by Region.WgServers, in repeated passes with backoff per
+// c.Retry; the server that succeeds is recorded in tun.Server.
+func (c *Client) Activate(ctx context.Context, tun *Tunnel) error {
+	servers := tun.Region.WgServers()
+	if len(servers) == 0 {
+		return fmt.Errorf("Region %s (%s) does not have a WireGuard server", tun.Region.Id, tun.Region.Name)
+	}
+	var err error
+	for pass := 0; pass < c.Retry.attempts(); pass++ {
+		if pass > 0 {
+			d := c.Retry.backoff(pass - 1)
+			fmt.Fprintf(os.Stderr, "Warning: all WireGuard servers for region %s failed; retrying in %v\n", tun.Region.Id, d)
+			if err := sleep(ctx, d); err != nil {
+				return err
+			}
+		}
+		for i := range servers {
+			s := &servers[i]
+			if err = c.activate(ctx, tun, s); err == nil {
+				tun.Server = *s
+				return nil
+			}
+			if ctx.Err() != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Warning: could not activate tunnel on %s (%s): %v\n", s.Cn, s.Ip, err)
+		}
+	}
+	return fmt.Errorf("gave up after %d attempts on %d servers: %w", c.Retry.attempts(), len(servers), err)
+}
+
+func (c *Client) activate(ctx context.Context, tun *Tunnel, server *Server) error {
+	url := fmt.Sprintf("https://%s:%d/addKey", server.Ip, c.wgAPIPort())
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return err
 	}
@@ -117,14 +205,14 @@ func (tun *Tunnel) Activate() error {
 	q.Add("pt", tun.Token.Token)
 	q.Add("pubkey", tun.PublicKey)
 	req.URL.RawQuery = q.Encode()
-	resp, err := doRequest(req, tun.Region.WgServer().Cn)
+	resp, err := c.doPinned(req, server.Cn)
 	if err != nil {
-		return err
+		return timeoutErr(req, err)
 	}
 	defer resp.Body.Close()
 
 	if err := json.NewDecoder(resp.Body).Decode(tun); err != nil {
-		return err
+		return timeoutErr(req, err)
 	}
 
 	if tun.Status != "OK" {
@@ -134,17 +222,59 @@ func (tun *Tunnel) Activate() error {
 	return nil
 }
 
+// SaveCache writes tun to the cache. The file is replaced atomically, so that
+// a concurrent reader sees either the old tunnel or the new one.
 func (tun *Tunnel) SaveCache(pathCache string) error {
 	path := fmt.Sprintf("%s/%s.json", pathCache, tun.Interface)
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o660)
+	b, err := json.Marshal(tun)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-	if err := json.NewEncoder(file).Encode(tun); err != nil {
+	return replaceFile(path, append(b, '\n'))
+}
+
+// replaceFile atomically replaces the file at path with one holding b. It
+// writes to a temporary file of its own first, since several of the
+// commands may be saving the same file at the same time.
+func replaceFile(path string, b []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
 		return err
 	}
-	return nil
+	defer os.Remove(file.Name())
+	_, err = file.Write(b)
+	if err == nil {
+		err = file.Chmod(0o660)
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// ErrTunnelChanged is returned by SavePFSig when the cached tunnel is no
+// longer the one the signature was obtained for.
+var ErrTunnelChanged = errors.New("tunnel was reset in the meantime")
+
+// SavePFSig records tun's port forwarding signature, and the token it was
+// obtained with, in the cache, leaving the rest of the cached tunnel as it
+// is. If the cached tunnel has meanwhile been replaced, as pia-setup-tunnel
+// does when it resets the tunnel, the signature belongs to the old tunnel and
+// ErrTunnelChanged is returned instead.
+func (tun *Tunnel) SavePFSig(pathCache string) error {
+	cached, err := ReadCache(pathCache, tun.Interface)
+	if err != nil {
+		return err
+	}
+	if cached.PublicKey != tun.PublicKey || cached.ServerVip != tun.ServerVip {
+		return ErrTunnelChanged
+	}
+	cached.PFSig = tun.PFSig
+	cached.Token = tun.Token
+	return cached.SaveCache(pathCache)
 }
 
 func ReadCache(pathCache string, ifname string) (*Tunnel, error) {
@@ -0,0 +1,154 @@
+package pia_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jdelkins/pia-tools/internal/pia"
+	"github.com/jdelkins/pia-tools/internal/pia/piatest"
+	"github.com/jdelkins/pia-tools/internal/wgkey"
+)
+
+// newTunnel returns a tunnel for r with a fresh key pair and a token from s.
+func newTunnel(t *testing.T, s *piatest.Server, c *pia.Client, r pia.Region) *pia.Tunnel {
+	t.Helper()
+	key, err := wgkey.GeneratePrivate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun := pia.NewTunnel(&r, "pia")
+	tun.PrivateKey = key.String()
+	tun.PublicKey = key.Public().String()
+	if err := c.NewToken(context.Background(), tun, s.Username, s.Password); err != nil {
+		t.Fatalf("NewToken: %v", err)
+	}
+	return tun
+}
+
+func TestActivateFailover(t *testing.T) {
+	// Nothing listens on 127.0.0.2, so connections to it are refused.
+	const down = "127.0.0.2"
+	tests := []struct {
+		name string
+		// servers are the region's WireGuard servers by CN; those whose
+		// CN starts with "down" are unreachable.
+		servers []string
+		setup   func(s *piatest.Server)
+		retry   pia.RetryPolicy
+		// want is the CN of the server activated on, or "" if Activate
+		// should fail.
+		want     string
+		requests int
+		// pause is the least time the backoff between passes should
+		// take.
+		pause time.Duration
+	}{
+		{
+			name:     "first server",
+			servers:  []string{"a", "b"},
+			want:     "a",
+			requests: 1,
+		},
+		{
+			name:     "first server unreachable",
+			servers:  []string{"down1", "b"},
+			want:     "b",
+			requests: 1,
+		},
+		{
+			name:     "first server refuses",
+			servers:  []string{"a", "b"},
+			setup:    func(s *piatest.Server) { s.FailOnce(piatest.AddKey, "ERROR", "Server overloaded") },
+			want:     "b",
+			requests: 2,
+		},
+		{
+			name:     "second pass after backoff",
+			servers:  []string{"a"},
+			setup:    func(s *piatest.Server) { s.FailOnce(piatest.AddKey, "ERROR", "Server overloaded") },
+			retry:    pia.RetryPolicy{Attempts: 2, Backoff: 50 * time.Millisecond},
+			want:     "a",
+			requests: 2,
+			pause:    50 * time.Millisecond,
+		},
+		{
+			name:     "all servers fail every pass",
+			servers:  []string{"down1", "b"},
+			setup:    func(s *piatest.Server) { s.Fail(piatest.AddKey, "ERROR", "Server overloaded") },
+			retry:    pia.RetryPolicy{Attempts: 3, Backoff: 20 * time.Millisecond},
+			requests: 3,
+			pause:    20*time.Millisecond + 40*time.Millisecond,
+		},
+		{
+			name:    "backoff is capped",
+			servers: []string{"down1"},
+			retry:   pia.RetryPolicy{Attempts: 4, Backoff: 20 * time.Millisecond, MaxBackoff: 30 * time.Millisecond},
+			pause:   20*time.Millisecond + 30*time.Millisecond + 30*time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := piatest.NewServer()
+			defer s.Close()
+			c := s.Client()
+			c.Retry = tt.retry
+			if c.Retry.Attempts == 0 {
+				c.Retry.Attempts = 1
+			}
+			r := s.NewRegion("fake_multi", "Fake Multiple Servers", true)
+			ip := r.WgServer().Ip
+			r.Servers["wg"] = nil
+			for _, cn := range tt.servers {
+				srv := pia.Server{Ip: ip, Cn: cn}
+				if strings.HasPrefix(cn, "down") {
+					srv.Ip = down
+				}
+				r.Servers["wg"] = append(r.Servers["wg"], srv)
+			}
+			tun := newTunnel(t, s, c, r)
+			if tt.setup != nil {
+				tt.setup(s)
+			}
+
+			start := time.Now()
+			err := c.Activate(context.Background(), tun)
+			elapsed := time.Since(start)
+			switch {
+			case tt.want == "" && err == nil:
+				t.Fatalf("Activate succeeded on %s, want an error", tun.Server.Cn)
+			case tt.want == "" && !strings.Contains(err.Error(), "gave up after"):
+				t.Errorf("Activate: %v, want it to give up", err)
+			case tt.want != "" && err != nil:
+				t.Fatalf("Activate: %v", err)
+			case tun.Server.Cn != tt.want:
+				t.Errorf("activated on %q, want %q", tun.Server.Cn, tt.want)
+			}
+			if tt.want != "" && tun.Status != "OK" {
+				t.Errorf("status %q, want OK", tun.Status)
+			}
+			if n := s.Requests(piatest.AddKey); n != tt.requests {
+				t.Errorf("addKey called %d times, want %d", n, tt.requests)
+			}
+			if elapsed < tt.pause {
+				t.Errorf("took %v, want at least %v of backoff", elapsed, tt.pause)
+			}
+		})
+	}
+}
+
+func TestActivateCanceledDuringBackoff(t *testing.T) {
+	s := piatest.NewServer()
+	defer s.Close()
+	c := s.Client()
+	c.Retry = pia.RetryPolicy{Attempts: 2, Backoff: time.Hour}
+	s.Fail(piatest.AddKey, "ERROR", "Server overloaded")
+	tun := newTunnel(t, s, c, s.Regions()[0])
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := c.Activate(ctx, tun); err != context.DeadlineExceeded {
+		t.Errorf("Activate: %v, want %v", err, context.DeadlineExceeded)
+	}
+}
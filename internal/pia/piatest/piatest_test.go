@@ -0,0 +1,192 @@
+package piatest_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jdelkins/pia-tools/internal/pia"
+	"github.com/jdelkins/pia-tools/internal/pia/piatest"
+	"github.com/jdelkins/pia-tools/internal/wgkey"
+)
+
+// instant answers every probe at once, since the fake server's latency is of
+// no interest.
+type instant struct{}
+
+func (instant) Probe(context.Context, string, int) (pia.Latency, error) {
+	return pia.Latency{Rtt: time.Millisecond}, nil
+}
+
+// newClient returns a client for s that gives up on a failing server at once,
+// so that failures are quick.
+func newClient(s *piatest.Server) *pia.Client {
+	c := s.Client()
+	c.Retry = pia.RetryPolicy{Attempts: 1}
+	c.Prober = instant{}
+	return c
+}
+
+// newTunnel looks up region id and returns a tunnel for it with a fresh key
+// pair, as pia-setup-tunnel does.
+func newTunnel(t *testing.T, c *pia.Client, id string) *pia.Tunnel {
+	t.Helper()
+	r, err := c.FindRegion(context.Background(), id)
+	if err != nil {
+		t.Fatalf("FindRegion(%q): %v", id, err)
+	}
+	key, err := wgkey.GeneratePrivate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun := pia.NewTunnel(r, "pia")
+	tun.PrivateKey = key.String()
+	tun.PublicKey = key.Public().String()
+	return tun
+}
+
+// step is one call in the setup and port forwarding flow.
+type step struct {
+	name string
+	run  func(ctx context.Context, c *pia.Client, s *piatest.Server, tun *pia.Tunnel) error
+}
+
+var flow = []step{
+	{"token", func(ctx context.Context, c *pia.Client, s *piatest.Server, tun *pia.Tunnel) error {
+		return c.NewToken(ctx, tun, s.Username, s.Password)
+	}},
+	{"addKey", func(ctx context.Context, c *pia.Client, s *piatest.Server, tun *pia.Tunnel) error {
+		return c.Activate(ctx, tun)
+	}},
+	{"getSignature", func(ctx context.Context, c *pia.Client, s *piatest.Server, tun *pia.Tunnel) error {
+		return c.NewPFSig(ctx, tun)
+	}},
+	{"bindPort", func(ctx context.Context, c *pia.Client, s *piatest.Server, tun *pia.Tunnel) error {
+		return c.BindPF(ctx, tun)
+	}},
+}
+
+func TestFlow(t *testing.T) {
+	s := piatest.NewServer()
+	defer s.Close()
+	c := newClient(s)
+	tun := newTunnel(t, c, "fake_pf")
+	ctx := context.Background()
+
+	for _, st := range flow {
+		if err := st.run(ctx, c, s, tun); err != nil {
+			t.Fatalf("%s: %v", st.name, err)
+		}
+	}
+	if !tun.Token.Valid() {
+		t.Errorf("token %+v is not valid", tun.Token)
+	}
+	if tun.PeerIp == "" || tun.ServerVip == "" || tun.ServerPubkey == "" {
+		t.Errorf("tunnel parameters not filled in: %+v", tun)
+	}
+	if tun.Server != *tun.Region.WgServer() {
+		t.Errorf("activated on %+v, want %+v", tun.Server, *tun.Region.WgServer())
+	}
+	if tun.PFSig.Port == 0 || !tun.PFSig.Valid() {
+		t.Errorf("port forwarding signature %+v is not valid", tun.PFSig)
+	}
+	if tun.PFSig.ServerVip != tun.ServerVip {
+		t.Errorf("signature recorded for %q, want %q", tun.PFSig.ServerVip, tun.ServerVip)
+	}
+	if !s.Bound(tun.PFSig.Port) {
+		t.Errorf("port %d was not bound", tun.PFSig.Port)
+	}
+	for _, ep := range []piatest.Endpoint{piatest.Token, piatest.AddKey, piatest.GetSignature, piatest.BindPort} {
+		if n := s.Requests(ep); n != 1 {
+			t.Errorf("%s called %d times, want 1", ep, n)
+		}
+	}
+}
+
+func TestFlowFailures(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(s *piatest.Server)
+		// before, if set, runs just before the step named at.
+		before func(s *piatest.Server)
+		at     string
+		want   string
+	}{
+		{
+			name:  "token refused",
+			setup: func(s *piatest.Server) { s.Fail(piatest.Token, "ERROR", "Too many requests") },
+			at:    "token",
+			want:  "Too many requests",
+		},
+		{
+			name:   "token expired before addKey",
+			before: func(s *piatest.Server) { s.ExpireTokens() },
+			at:     "addKey",
+			want:   "Login failed!",
+		},
+		{
+			name:   "token expired before getSignature",
+			before: func(s *piatest.Server) { s.ExpireTokens() },
+			at:     "getSignature",
+			want:   "Login failed!",
+		},
+		{
+			name:  "addKey bad status",
+			setup: func(s *piatest.Server) { s.Fail(piatest.AddKey, "ERROR", "Server overloaded") },
+			at:    "addKey",
+			want:  "Server overloaded",
+		},
+		{
+			name:  "getSignature bad status",
+			setup: func(s *piatest.Server) { s.Fail(piatest.GetSignature, "ERROR", "Port forwarding not supported") },
+			at:    "getSignature",
+			want:  "Port forwarding not supported",
+		},
+		{
+			name:  "malformed payload",
+			setup: func(s *piatest.Server) { s.MalformPayload(true) },
+			at:    "getSignature",
+			want:  "illegal base64",
+		},
+		{
+			name:  "bindPort bad status",
+			setup: func(s *piatest.Server) { s.Fail(piatest.BindPort, "ERROR", "Signature expired") },
+			at:    "bindPort",
+			want:  "Signature expired",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := piatest.NewServer()
+			defer s.Close()
+			c := newClient(s)
+			tun := newTunnel(t, c, "fake_pf")
+			if tt.setup != nil {
+				tt.setup(s)
+			}
+			ctx := context.Background()
+
+			for _, st := range flow {
+				if st.name == tt.at && tt.before != nil {
+					tt.before(s)
+				}
+				err := st.run(ctx, c, s, tun)
+				if st.name != tt.at {
+					if err != nil {
+						t.Fatalf("%s: %v", st.name, err)
+					}
+					continue
+				}
+				if err == nil {
+					t.Fatalf("%s succeeded, want an error containing %q", st.name, tt.want)
+				}
+				if !strings.Contains(err.Error(), tt.want) {
+					t.Errorf("%s: got error %q, want one containing %q", st.name, err, tt.want)
+				}
+				return
+			}
+			t.Fatalf("no step named %q", tt.at)
+		})
+	}
+}
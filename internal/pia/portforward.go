@@ -1,10 +1,12 @@
 package pia
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
 	"time"
 )
 
@@ -13,9 +15,47 @@ type PortForwardSig struct {
 	Expiry    time.Time `json:"expires_at"`
 	Signature string    `json:"signature"`
 	Payload   string    `json:"payload"`
+	// ServerVip is the tunnel's server VIP when the signature was issued.
+	// Signatures are only good on the server that issued them.
+	ServerVip string `json:"server_vip,omitempty"`
+}
+
+func (s PortForwardSig) Valid() bool {
+	return s.ValidFor(0)
+}
+
+// ValidFor reports whether s is present and will not expire for at least d.
+func (s PortForwardSig) ValidFor(d time.Duration) bool {
+	return s.Payload != "" && time.Now().Add(d).Before(s.Expiry)
+}
+
+// pfSigProblem describes why tun's cached signature should not be used, or
+// returns "" if it looks usable for at least margin.
+func (tun *Tunnel) pfSigProblem(margin time.Duration) string {
+	switch {
+	case tun.PFSig.Payload == "":
+		return "no port forwarding signature is cached"
+	case tun.PFSig.ServerVip != "" && tun.PFSig.ServerVip != tun.ServerVip:
+		return fmt.Sprintf("cached port forwarding signature for port %d was issued by %s, but the tunnel is now on %s", tun.PFSig.Port, tun.PFSig.ServerVip, tun.ServerVip)
+	case !tun.PFSig.Valid():
+		return fmt.Sprintf("cached port forwarding signature for port %d expired at %s", tun.PFSig.Port, tun.PFSig.Expiry.Format(time.RFC3339))
+	case !tun.PFSig.ValidFor(margin):
+		return fmt.Sprintf("cached port forwarding signature for port %d expires at %s", tun.PFSig.Port, tun.PFSig.Expiry.Format(time.RFC3339))
+	}
+	return ""
 }
 
 func (tun *Tunnel) NewPFSig() error {
+	return tun.NewPFSigContext(context.Background())
+}
+
+func (tun *Tunnel) NewPFSigContext(ctx context.Context) error {
+	return DefaultClient.NewPFSig(ctx, tun)
+}
+
+// NewPFSig requests a new port forwarding assignment for tun and stores the
+// resulting signature in tun.PFSig.
+func (c *Client) NewPFSig(ctx context.Context, tun *Tunnel) error {
 	// Explanation of PIA's /getSignature endpoint
 	// You call this endpoint with a valid token, and it returns a json string
 	// encoding a dict with these fields:
@@ -34,17 +74,17 @@ func (tun *Tunnel) NewPFSig() error {
 	// I use a kind of cute approach to store both the payload as well as the
 	// decoded contents of payload, all in one little struct, namely to unmarshal
 	// payload on top of its containing struct.
-	url := fmt.Sprintf("https://%s:19999/getSignature", tun.ServerVip)
-	req, err := http.NewRequest("GET", url, nil)
+	url := fmt.Sprintf("https://%s:%d/getSignature", tun.ServerVip, c.pfAPIPort())
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return err
 	}
 	q := req.URL.Query()
 	q.Add("token", tun.Token.Token)
 	req.URL.RawQuery = q.Encode()
-	resp, err := doRequest(req, tun.Region.WgServer().Cn)
+	resp, err := c.doPinned(req, tun.WgServer().Cn)
 	if err != nil {
-		return err
+		return timeoutErr(req, err)
 	}
 	defer resp.Body.Close()
 	// A disposable wrapper to grab the request status and any error message.
@@ -56,7 +96,7 @@ func (tun *Tunnel) NewPFSig() error {
 		PortForwardSig
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
-		return err
+		return timeoutErr(req, err)
 	}
 	if r.Status != "OK" {
 		return fmt.Errorf("could not get new port forward signature: status=\"%s\" message=\"%s\"", r.Status, r.Message)
@@ -70,12 +110,22 @@ func (tun *Tunnel) NewPFSig() error {
 		return err
 	}
 	tun.PFSig = r.PortForwardSig
+	tun.PFSig.ServerVip = tun.ServerVip
 	return nil
 }
 
 func (tun *Tunnel) BindPF() error {
-	url := fmt.Sprintf("https://%s:19999/bindPort", tun.ServerVip)
-	req, err := http.NewRequest("GET", url, nil)
+	return tun.BindPFContext(context.Background())
+}
+
+func (tun *Tunnel) BindPFContext(ctx context.Context) error {
+	return DefaultClient.BindPF(ctx, tun)
+}
+
+// BindPF binds (or refreshes) tun's current port forwarding assignment.
+func (c *Client) BindPF(ctx context.Context, tun *Tunnel) error {
+	url := fmt.Sprintf("https://%s:%d/bindPort", tun.ServerVip, c.pfAPIPort())
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return err
 	}
@@ -83,9 +133,9 @@ func (tun *Tunnel) BindPF() error {
 	q.Add("payload", tun.PFSig.Payload)
 	q.Add("signature", tun.PFSig.Signature)
 	req.URL.RawQuery = q.Encode()
-	resp, err := doRequest(req, tun.Region.WgServer().Cn)
+	resp, err := c.doPinned(req, tun.WgServer().Cn)
 	if err != nil {
-		return err
+		return timeoutErr(req, err)
 	}
 	defer resp.Body.Close()
 
@@ -94,7 +144,7 @@ func (tun *Tunnel) BindPF() error {
 		Message string `json:"message"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
-		return err
+		return timeoutErr(req, err)
 	}
 	if r.Status != "OK" {
 		return fmt.Errorf("could not bind port forward assignment: status=\"%s\" message=\"%s\"", r.Status, r.Message)
@@ -103,3 +153,38 @@ func (tun *Tunnel) BindPF() error {
 	tun.Message = r.Message
 	return nil
 }
+
+func (tun *Tunnel) RefreshPF(margin time.Duration) (renewed bool, err error) {
+	return tun.RefreshPFContext(context.Background(), margin)
+}
+
+func (tun *Tunnel) RefreshPFContext(ctx context.Context, margin time.Duration) (renewed bool, err error) {
+	return DefaultClient.RefreshPF(ctx, tun, margin)
+}
+
+// RefreshPF keeps tun's port forwarding assignment alive. If the cached
+// signature is missing, expires within margin, or was issued for a different
+// server VIP (ie the tunnel has been reset), a new one is requested before
+// binding; if PIA rejects the cached signature, a new one is requested and
+// bound once more. It reports whether a new signature, and so possibly a new
+// port, was acquired.
+func (c *Client) RefreshPF(ctx context.Context, tun *Tunnel, margin time.Duration) (renewed bool, err error) {
+	if problem := tun.pfSigProblem(margin); problem != "" {
+		if tun.PFSig.Payload != "" {
+			fmt.Fprintf(os.Stderr, "Warning: %s; requesting a new one\n", problem)
+		}
+		if err := c.NewPFSig(ctx, tun); err != nil {
+			return false, err
+		}
+		renewed = true
+	}
+	err = c.BindPF(ctx, tun)
+	if err == nil || renewed || ctx.Err() != nil {
+		return renewed, err
+	}
+	fmt.Fprintf(os.Stderr, "Warning: %v; requesting a new port forwarding signature\n", err)
+	if err := c.NewPFSig(ctx, tun); err != nil {
+		return false, err
+	}
+	return true, c.BindPF(ctx, tun)
+}
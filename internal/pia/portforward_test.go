@@ -0,0 +1,124 @@
+package pia_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jdelkins/pia-tools/internal/pia"
+	"github.com/jdelkins/pia-tools/internal/pia/piatest"
+)
+
+func TestRefreshPF(t *testing.T) {
+	const margin = 24 * time.Hour
+	tests := []struct {
+		name string
+		// modify adjusts the tunnel, which holds a valid, bound
+		// signature, before RefreshPF.
+		modify  func(tun *pia.Tunnel)
+		setup   func(s *piatest.Server)
+		renewed bool
+		// signatures is how many times getSignature is called by
+		// RefreshPF.
+		signatures int
+		wantErr    bool
+	}{
+		{
+			name:   "valid signature is rebound",
+			modify: func(tun *pia.Tunnel) {},
+		},
+		{
+			name:       "no signature",
+			modify:     func(tun *pia.Tunnel) { tun.PFSig = pia.PortForwardSig{} },
+			renewed:    true,
+			signatures: 1,
+		},
+		{
+			name:       "expired",
+			modify:     func(tun *pia.Tunnel) { tun.PFSig.Expiry = time.Now().Add(-time.Minute) },
+			renewed:    true,
+			signatures: 1,
+		},
+		{
+			name:       "expires within margin",
+			modify:     func(tun *pia.Tunnel) { tun.PFSig.Expiry = time.Now().Add(margin / 2) },
+			renewed:    true,
+			signatures: 1,
+		},
+		{
+			name:       "issued by another server",
+			modify:     func(tun *pia.Tunnel) { tun.PFSig.ServerVip = "10.9.9.9" },
+			renewed:    true,
+			signatures: 1,
+		},
+		{
+			name:       "rejected by PIA",
+			modify:     func(tun *pia.Tunnel) { tun.PFSig.Signature = "forged" },
+			renewed:    true,
+			signatures: 1,
+		},
+		{
+			name:       "cannot renew",
+			modify:     func(tun *pia.Tunnel) { tun.PFSig = pia.PortForwardSig{} },
+			setup:      func(s *piatest.Server) { s.ExpireTokens() },
+			signatures: 1,
+			wantErr:    true,
+		},
+		{
+			name:    "bind fails",
+			modify:  func(tun *pia.Tunnel) { tun.PFSig = pia.PortForwardSig{} },
+			setup:   func(s *piatest.Server) { s.Fail(piatest.BindPort, "ERROR", "Port unavailable") },
+			renewed: true,
+			// a fresh signature that fails to bind is not retried
+			signatures: 1,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := piatest.NewServer()
+			defer s.Close()
+			c := s.Client()
+			tun := newTunnel(t, s, c, s.Regions()[0])
+			ctx := context.Background()
+			if err := c.Activate(ctx, tun); err != nil {
+				t.Fatalf("Activate: %v", err)
+			}
+			if err := c.NewPFSig(ctx, tun); err != nil {
+				t.Fatalf("NewPFSig: %v", err)
+			}
+			if err := c.BindPF(ctx, tun); err != nil {
+				t.Fatalf("BindPF: %v", err)
+			}
+			old := tun.PFSig.Port
+			tt.modify(tun)
+			if tt.setup != nil {
+				tt.setup(s)
+			}
+			before := s.Requests(piatest.GetSignature)
+
+			renewed, err := c.RefreshPF(ctx, tun, margin)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RefreshPF: error %v, want error %v", err, tt.wantErr)
+			}
+			if renewed != tt.renewed {
+				t.Errorf("renewed = %v, want %v", renewed, tt.renewed)
+			}
+			if n := s.Requests(piatest.GetSignature) - before; n != tt.signatures {
+				t.Errorf("getSignature called %d times, want %d", n, tt.signatures)
+			}
+			if err != nil {
+				return
+			}
+			if renewed == (tun.PFSig.Port == old) {
+				t.Errorf("port went from %d to %d, but renewed = %v", old, tun.PFSig.Port, renewed)
+			}
+			if !s.Bound(tun.PFSig.Port) {
+				t.Errorf("port %d was not bound", tun.PFSig.Port)
+			}
+			if tun.PFSig.ServerVip != tun.ServerVip {
+				t.Errorf("signature recorded for %q, want %q", tun.PFSig.ServerVip, tun.ServerVip)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package pia
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-ping/ping"
+)
+
+// Probe modes, the values of ProbeOptions.Probe.
+const (
+	ProbeICMP            = "icmp"
+	ProbeUDPUnprivileged = "udp-unprivileged"
+	ProbeTCPConnect      = "tcp-connect"
+)
+
+// probeInterval separates the echo requests of an ICMP probe. go-ping's
+// default of a second would leave most of them unsent within the timeout.
+const probeInterval = 100 * time.Millisecond
+
+// Latency is the outcome of probing a server.
+type Latency struct {
+	// Rtt is the average round trip time of the probes that were answered.
+	Rtt time.Duration
+	// Loss is the percentage of probes that went unanswered.
+	Loss float64
+}
+
+// Prober measures the latency to a server. port is only meaningful to
+// probes that use it, such as TCPProber. An error means that no probe was
+// answered, or that none could be sent.
+type Prober interface {
+	Probe(ctx context.Context, ip string, port int) (Latency, error)
+}
+
+// ICMPProber sends echo requests with go-ping. Privileged probes use a raw
+// socket, which requires CAP_NET_RAW; others use an ICMP datagram socket,
+// which requires net.ipv4.ping_group_range to include the user's group.
+type ICMPProber struct {
+	Count      int
+	Timeout    time.Duration
+	Privileged bool
+}
+
+func (p ICMPProber) Probe(ctx context.Context, ip string, _ int) (Latency, error) {
+	pinger, err := ping.NewPinger(ip)
+	if err != nil {
+		return Latency{}, err
+	}
+	pinger.Count = p.Count
+	pinger.Timeout = p.Timeout
+	pinger.Interval = probeInterval
+	pinger.SetPrivileged(p.Privileged)
+	stop := context.AfterFunc(ctx, pinger.Stop)
+	defer stop()
+	if err := pinger.Run(); err != nil {
+		return Latency{}, fmt.Errorf("could not ping %s: %w", ip, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return Latency{}, err
+	}
+	stats := pinger.Statistics()
+	lat := Latency{Rtt: stats.AvgRtt, Loss: stats.PacketLoss}
+	if stats.PacketsRecv == 0 {
+		return Latency{Loss: 100}, fmt.Errorf("no reply to pings to %s", ip)
+	}
+	return lat, nil
+}
+
+// TCPProber times TCP handshakes, one after another, which needs no
+// privileges at all. A refused connection is answered as promptly as an
+// accepted one, so it counts as a reply. Timeout bounds all Count attempts
+// together.
+type TCPProber struct {
+	Count   int
+	Timeout time.Duration
+}
+
+func (p TCPProber) Probe(ctx context.Context, ip string, port int) (Latency, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
+	var dialer net.Dialer
+	var total time.Duration
+	var answered, sent int
+	var last error
+	for sent < p.Count && ctx.Err() == nil {
+		sent++
+		start := time.Now()
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		rtt := time.Since(start)
+		switch {
+		case err == nil:
+			conn.Close()
+		case errors.Is(err, syscall.ECONNREFUSED):
+		default:
+			last = err
+			continue
+		}
+		total += rtt
+		answered++
+	}
+	if answered == 0 {
+		if last == nil {
+			last = ctx.Err()
+		}
+		return Latency{Loss: 100}, fmt.Errorf("could not connect to %s: %w", addr, last)
+	}
+	return Latency{
+		Rtt:  total / time.Duration(answered),
+		Loss: 100 * float64(sent-answered) / float64(sent),
+	}, nil
+}
+
+// ProbeOptions selects how region latency is measured.
+type ProbeOptions struct {
+	// Probe is one of ProbeICMP, ProbeUDPUnprivileged or ProbeTCPConnect;
+	// anything else means ProbeUDPUnprivileged.
+	Probe string
+
+	// ProbeCount probes are sent to each server, and those not answered
+	// within ProbeTimeout are lost.
+	ProbeCount   int
+	ProbeTimeout time.Duration
+
+	// Parallel and ProbeDeadline become the Client's.
+	Parallel      int
+	ProbeDeadline time.Duration
+}
+
+// Configure makes c probe as the options describe.
+func (o ProbeOptions) Configure(c *Client) {
+	c.Prober = o.Prober()
+	c.Parallel = o.Parallel
+	c.ProbeDeadline = o.ProbeDeadline
+}
+
+// Prober returns the Prober the options describe.
+func (o ProbeOptions) Prober() Prober {
+	switch o.Probe {
+	case ProbeICMP:
+		return ICMPProber{Count: o.ProbeCount, Timeout: o.ProbeTimeout, Privileged: true}
+	case ProbeTCPConnect:
+		return TCPProber{Count: o.ProbeCount, Timeout: o.ProbeTimeout}
+	}
+	return ICMPProber{Count: o.ProbeCount, Timeout: o.ProbeTimeout}
+}
+
+// ProbeResult is the outcome of probing one region. Region points into the
+// slice given to ProbeRegions; Err, if not nil, says why it is unreachable.
+type ProbeResult struct {
+	Region *Region
+	Err    error
+}
+
+// ProbeRegions probes regions, c.Parallel at a time, and sends the outcome
+// for each on the returned channel as soon as it is known, so the fastest
+// regions tend to come first. Every region is reported exactly once, after
+// which the channel is closed; the regions must not be touched until then.
+// Once ctx is done, or c.ProbeDeadline has passed, the regions not yet
+// probed are reported with the context's error.
+func (c *Client) ProbeRegions(ctx context.Context, regions []Region) <-chan ProbeResult {
+	cancel := func() {}
+	if c.ProbeDeadline > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.ProbeDeadline)
+	}
+	// Buffered, so that workers never block on a reader that stops early.
+	results := make(chan ProbeResult, len(regions))
+	next := make(chan *Region)
+	var done sync.WaitGroup
+	for range min(c.parallel(), len(regions)) {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			for r := range next {
+				var err error
+				if ctx.Err() == nil {
+					err = c.probe(ctx, r)
+				} else {
+					r.PingTime, r.PacketLoss = 0, 0
+					err = fmt.Errorf("not probed: %w", ctx.Err())
+				}
+				results <- ProbeResult{Region: r, Err: err}
+			}
+		}()
+	}
+	go func() {
+		for i := range regions {
+			next <- &regions[i]
+		}
+		close(next)
+		done.Wait()
+		cancel()
+		close(results)
+	}()
+	return results
+}
+
+func (c *Client) parallel() int {
+	if c.Parallel > 0 {
+		return c.Parallel
+	}
+	return DefaultParallel
+}
+
+func (c *Client) prober() Prober {
+	if c.Prober != nil {
+		return c.Prober
+	}
+	return ICMPProber{Count: DefaultProbeCount, Timeout: DefaultProbeTimeout}
+}
+
+// probe measures the latency to r's WireGuard server, or, if it has none, its
+// meta server, and records it in r. On error, r is left unreachable.
+func (c *Client) probe(ctx context.Context, r *Region) error {
+	r.PingTime, r.PacketLoss = 0, 0
+	target, port := r.WgServer(), c.wgAPIPort()
+	if target == nil {
+		target, port = r.MetaServer(), c.metaPort()
+	}
+	if target == nil {
+		return fmt.Errorf("region %s has no server to probe", r.Id)
+	}
+	lat, err := c.prober().Probe(ctx, target.Ip, port)
+	r.PingTime, r.PacketLoss = lat.Rtt, lat.Loss
+	if err != nil {
+		r.PingTime = 0
+	}
+	return err
+}
@@ -1,117 +1,217 @@
 package pia
 
 import (
+	"bytes"
+	"cmp"
+	"context"
 	"encoding/json"
 	"fmt"
-	"net/http"
 	"os"
+	"slices"
 	"sort"
 	"sync"
 	"time"
+)
 
-	"github.com/go-ping/ping"
+// Server types, the keys of Region.Servers.
+const (
+	ServerMeta    = "meta"
+	ServerWg      = "wg"
+	ServerOvpnTCP = "ovpntcp"
+	ServerOvpnUDP = "ovpnudp"
+	ServerIKEv2   = "ikev2"
 )
 
+// Region is a region as described by PIA's serverlist.
 type Region struct {
-	Id          string              `json:"id"`
-	Name        string              `json:"name"`
-	PortForward bool                `json:"port_forward"`
-	Servers     map[string][]Server `json:"servers"`
-	PingTime    time.Duration
+	Id      string `json:"id"`
+	Name    string `json:"name"`
+	Country string `json:"country"` // ISO code, eg "US"
+	// Dns is the region's hostname, eg "us-california.privacy.network".
+	Dns         string `json:"dns"`
+	PortForward bool   `json:"port_forward"`
+	// Geo marks a virtual location: the servers are physically elsewhere.
+	Geo bool `json:"geo"`
+	// Offline regions are listed but not currently usable.
+	Offline bool `json:"offline"`
+	// AutoRegion marks the regions PIA's own clients choose from
+	// automatically.
+	AutoRegion bool                `json:"auto_region"`
+	Servers    map[string][]Server `json:"servers"`
+	// PingTime is the average round trip time measured by the Client's
+	// Prober, or 0 if the region could not be reached, and PacketLoss the
+	// percentage of probes that went unanswered.
+	PingTime   time.Duration
+	PacketLoss float64
 }
 
 func (self *Region) server(typ string) *Server {
 	s, ok := self.Servers[typ]
-	if !ok {
+	if !ok || len(s) == 0 {
 		return nil
 	}
 	return &s[0]
 }
 
 func (self *Region) WgServer() *Server {
-	return self.server("wg")
+	return self.server(ServerWg)
 }
 
-func (self *Region) MetaServer() *Server {
-	return self.server("meta")
+// WgServers returns all of the region's WireGuard servers, in the order they
+// should be tried.
+func (self *Region) WgServers() []Server {
+	return self.Servers[ServerWg]
 }
 
-func (self *Region) HasWg() bool {
-	return self.WgServer() != nil
+func (self *Region) OvpnTCPServers() []Server {
+	return self.Servers[ServerOvpnTCP]
 }
 
-func (self *Region) setPingTime() {
-	wg := self.WgServer()
-	if wg == nil {
-		self.PingTime = time.Duration(0)
-		return
-	}
-	pinger, err := ping.NewPinger(wg.Ip)
-	if err != nil {
-		self.PingTime = time.Duration(0)
-	}
-	pinger.Count = 3
-	pinger.Timeout = 1 * time.Second
-	pinger.OnFinish = func(stats *ping.Statistics) {
-		self.PingTime = stats.AvgRtt
-	}
-	err = pinger.Run()
-	if err != nil {
-		self.PingTime = time.Duration(0)
-	}
-	return
+func (self *Region) OvpnUDPServers() []Server {
+	return self.Servers[ServerOvpnUDP]
 }
 
-func RegionsWithPingTime() ([]Region, error) {
-	regions, err := Regions()
-	if err != nil {
-		return nil, err
-	}
+func (self *Region) IKEv2Servers() []Server {
+	return self.Servers[ServerIKEv2]
+}
 
-	// parallelize the pings, obviously, or we'll be here all day
+// SortWgServersByLatency probes each of the region's WireGuard servers and
+// reorders them from fastest to slowest; unreachable servers go last.
+func (self *Region) SortWgServersByLatency() {
+	DefaultClient.SortWgServersByLatency(context.Background(), self)
+}
+
+// SortWgServersByLatency probes each of r's WireGuard servers on the
+// WireGuard API port and reorders them from fastest to slowest; unreachable
+// servers go last.
+func (c *Client) SortWgServersByLatency(ctx context.Context, r *Region) {
+	servers := r.WgServers()
+	times := make([]time.Duration, len(servers))
 	var done sync.WaitGroup
-	for i := range regions {
-		r := &regions[i]
+	for i := range servers {
 		done.Add(1)
-		go func(done *sync.WaitGroup) {
-			r.setPingTime()
-			done.Done()
-		}(&done)
+		go func(i int) {
+			defer done.Done()
+			if lat, err := c.prober().Probe(ctx, servers[i].Ip, c.wgAPIPort()); err == nil {
+				times[i] = lat.Rtt
+			}
+		}(i)
 	}
 	done.Wait()
-
-	// sort by increasing ping time
-	sort.Slice(regions, func(i, j int) bool {
-		if regions[i].PingTime == 0 {
+	idx := make([]int, len(servers))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		ta, tb := times[idx[a]], times[idx[b]]
+		if ta == 0 {
 			return false
 		}
-		if regions[j].PingTime == 0 {
+		if tb == 0 {
 			return true
 		}
-		return regions[i].PingTime < regions[j].PingTime
+		return ta < tb
 	})
-	return regions, nil
+	sorted := make([]Server, len(servers))
+	for i, j := range idx {
+		sorted[i] = servers[j]
+	}
+	r.Servers[ServerWg] = sorted
 }
 
-func Regions() ([]Region, error) {
-	const pia_url_servers = "https://serverlist.piaservers.net/vpninfo/servers/v4"
-	resp, err := http.Get(pia_url_servers)
+func (self *Region) MetaServer() *Server {
+	return self.server(ServerMeta)
+}
+
+func (self *Region) HasWg() bool {
+	return self.WgServer() != nil
+}
+
+func RegionsWithPingTime() ([]Region, error) {
+	return RegionsWithPingTimeContext(context.Background())
+}
+
+func RegionsWithPingTimeContext(ctx context.Context) ([]Region, error) {
+	return DefaultClient.RegionsWithPingTime(ctx)
+}
+
+// RegionsWithPingTime fetches the region list and probes each region's
+// WireGuard server (or meta server, if it has none) with ProbeRegions,
+// returning the regions sorted by increasing ping time.
+func (c *Client) RegionsWithPingTime(ctx context.Context) ([]Region, error) {
+	regions, err := c.Regions(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
+	// the results are recorded in regions; just wait for them all
+	for range c.ProbeRegions(ctx, regions) {
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	slices.SortStableFunc(regions, ComparePingTime)
+	return regions, nil
+}
+
+// ComparePingTime orders regions by increasing ping time, with unreachable
+// regions last, for use with slices.SortStableFunc.
+func ComparePingTime(a, b Region) int {
+	switch {
+	case a.PingTime == b.PingTime:
+		return 0
+	case a.PingTime == 0:
+		return 1
+	case b.PingTime == 0:
+		return -1
+	}
+	return cmp.Compare(a.PingTime, b.PingTime)
+}
+
+func Regions() ([]Region, error) {
+	return RegionsContext(context.Background())
+}
+
+func RegionsContext(ctx context.Context) ([]Region, error) {
+	return DefaultClient.Regions(ctx)
+}
+
+// Regions fetches the list of regions from PIA's serverlist, or from the
+// cache in c.ServerlistCacheDir, if any.
+func (c *Client) Regions(ctx context.Context) ([]Region, error) {
+	regions, _, err := c.RegionsWithAge(ctx)
+	return regions, err
+}
+
+// RegionsWithAge is like Regions, but also returns the age of the serverlist
+// the regions come from: zero if it was fetched, or revalidated, just now;
+// otherwise, how long ago the cached copy was.
+func (c *Client) RegionsWithAge(ctx context.Context) ([]Region, time.Duration, error) {
+	body, age, err := c.serverlist(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	data, _, _ := bytes.Cut(body, []byte("\n"))
 	var _r struct {
 		Regions []Region `json:"regions"`
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&_r); err != nil {
-		return nil, err
+	if err := json.Unmarshal(data, &_r); err != nil {
+		return nil, 0, fmt.Errorf("parsing serverlist: %w", err)
 	}
-	return _r.Regions, nil
+	return _r.Regions, age, nil
 }
 
 func FindRegion(id string) (*Region, error) {
-	regions, err := Regions()
+	return FindRegionContext(context.Background(), id)
+}
+
+func FindRegionContext(ctx context.Context, id string) (*Region, error) {
+	return DefaultClient.FindRegion(ctx, id)
+}
+
+// FindRegion looks up the region with the given id and measures its ping time.
+func (c *Client) FindRegion(ctx context.Context, id string) (*Region, error) {
+	regions, err := c.Regions(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -121,9 +221,11 @@ func FindRegion(id string) (*Region, error) {
 			if r.WgServer() == nil {
 				return nil, fmt.Errorf("Region %s (%s) was found but does not have a WireGuard server", r.Id, r.Name)
 			}
-			r.setPingTime()
-			if r.PingTime == 0 {
-				fmt.Fprintf(os.Stderr, "Warning: WireGuard server for region %s (%s) is not currently reachable at %s", r.Id, r.Name, r.WgServer().Ip)
+			if r.Offline {
+				fmt.Fprintf(os.Stderr, "Warning: region %s (%s) is marked offline\n", r.Id, r.Name)
+			}
+			if err := c.probe(ctx, r); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: WireGuard server for region %s (%s) is not currently reachable at %s: %v\n", r.Id, r.Name, r.WgServer().Ip, err)
 			}
 			return r, nil
 		}
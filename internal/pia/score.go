@@ -0,0 +1,215 @@
+package pia
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Selection strategies, the values of ScoreOptions.Strategy.
+const (
+	StrategyPing  = "ping"
+	StrategyScore = "score"
+)
+
+// DefaultThroughputPath is fetched from a region's meta server to measure
+// throughput: the serverlist, which the meta servers also serve.
+const DefaultThroughputPath = "/vpninfo/servers/v4"
+
+// Selection records why a region was chosen automatically. It is kept in the
+// Tunnel, and so in the cache.
+type Selection struct {
+	Strategy string `json:"strategy"`
+	// Score is the chosen region's score; lower is better. With the ping
+	// strategy, it is simply the ping time in ms.
+	Score float64       `json:"score"`
+	Rtt   time.Duration `json:"rtt"`
+	Loss  float64       `json:"loss"`
+	// Throughput is the measured download rate in Mbit/s, or 0 if it was
+	// not measured.
+	Throughput float64 `json:"throughput,omitempty"`
+	Reason     string  `json:"reason"`
+	// Previous is the region the tunnel used before, if known.
+	Previous string `json:"previous,omitempty"`
+}
+
+// ScoreOptions governs automatic region selection.
+//
+// With the score strategy, a region's score is its ping time in ms, plus
+// LossWeight for each percent of packet loss, less ThroughputWeight for each
+// Mbit/s of throughput, if measured. The previously used region is kept
+// unless another scores better by more than StickyMargin.
+type ScoreOptions struct {
+	// Strategy is StrategyPing or StrategyScore.
+	Strategy string
+
+	LossWeight float64
+
+	// ThroughputProbe measures the throughput of the ThroughputCandidates
+	// best-scoring regions, by fetching ThroughputPath (empty means
+	// DefaultThroughputPath) for at most ThroughputDuration each.
+	ThroughputProbe      bool
+	ThroughputWeight     float64
+	ThroughputCandidates int
+	ThroughputDuration   time.Duration
+	ThroughputPath       string
+
+	StickyMargin float64
+}
+
+// candidate is a region being scored.
+type candidate struct {
+	r          *Region
+	score      float64
+	throughput float64
+}
+
+// SelectRegion chooses among regions, which must have been probed, as o
+// directs. previous is the id of the region the tunnel used before, or "".
+func (c *Client) SelectRegion(ctx context.Context, regions []Region, previous string, o ScoreOptions) (*Region, *Selection, error) {
+	var cands []candidate
+	for i := range regions {
+		r := &regions[i]
+		if r.PingTime == 0 {
+			continue
+		}
+		cands = append(cands, candidate{r: r, score: float64(r.PingTime.Microseconds())/1000 + r.PacketLoss*o.LossWeight})
+	}
+	switch {
+	case len(regions) == 0:
+		return nil, nil, fmt.Errorf("no region to choose from")
+	case len(cands) == 0:
+		fmt.Fprintf(os.Stderr, "Warning: none of %d regions could be probed\n", len(regions))
+		return &regions[0], &Selection{
+			Strategy: o.Strategy,
+			Reason:   "no region could be probed, so took the first",
+			Previous: previous,
+		}, nil
+	}
+	byScore := func(a, b candidate) int { return cmp.Compare(a.score, b.score) }
+
+	if o.Strategy != StrategyScore {
+		slices.SortStableFunc(cands, func(a, b candidate) int { return ComparePingTime(*a.r, *b.r) })
+		best := cands[0]
+		return best.r, &Selection{
+			Strategy: StrategyPing,
+			Score:    float64(best.r.PingTime.Microseconds()) / 1000,
+			Rtt:      best.r.PingTime,
+			Loss:     best.r.PacketLoss,
+			Reason:   fmt.Sprintf("lowest ping time of %d reachable regions", len(cands)),
+			Previous: previous,
+		}, nil
+	}
+
+	slices.SortStableFunc(cands, byScore)
+	if o.ThroughputProbe {
+		n := max(o.ThroughputCandidates, 1)
+		if len(cands) > n {
+			// the previous region stays in the running, so that it can be
+			// compared on equal terms
+			keep := cands[:n:n]
+			for _, cand := range cands[n:] {
+				if cand.r.Id == previous {
+					keep = append(keep, cand)
+				}
+			}
+			cands = keep
+		}
+		for i := range cands {
+			mbps, err := c.throughput(ctx, cands[i].r, o)
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: could not measure throughput of region %s: %v\n", cands[i].r.Id, err)
+				continue
+			}
+			cands[i].throughput = mbps
+			cands[i].score -= mbps * o.ThroughputWeight
+		}
+		slices.SortStableFunc(cands, byScore)
+	}
+
+	best := cands[0]
+	chosen := best
+	var reason string
+	prev := slices.IndexFunc(cands, func(cand candidate) bool { return cand.r.Id == previous })
+	switch {
+	case previous == "" || prev < 0:
+		reason = fmt.Sprintf("best score of %d regions", len(cands))
+		if previous != "" {
+			reason += fmt.Sprintf("; previous region %s is no longer a candidate", previous)
+		}
+	case prev == 0:
+		reason = fmt.Sprintf("best score of %d regions, and the previous region", len(cands))
+	case cands[prev].score-best.score <= o.StickyMargin:
+		chosen = cands[prev]
+		reason = fmt.Sprintf("previous region, within %g of the best score, %.1f of %s", o.StickyMargin, best.score, best.r.Id)
+	default:
+		reason = fmt.Sprintf("best score of %d regions, better by more than %g than previous region %s at %.1f", len(cands), o.StickyMargin, previous, cands[prev].score)
+	}
+	return chosen.r, &Selection{
+		Strategy:   StrategyScore,
+		Score:      chosen.score,
+		Rtt:        chosen.r.PingTime,
+		Loss:       chosen.r.PacketLoss,
+		Throughput: chosen.throughput,
+		Reason:     scoreTerms(chosen, o) + "; " + reason,
+		Previous:   previous,
+	}, nil
+}
+
+// scoreTerms explains how cand's score was arrived at.
+func scoreTerms(cand candidate, o ScoreOptions) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "score %.1f = %.1f ms + %.1f%% loss × %g", cand.score, float64(cand.r.PingTime.Microseconds())/1000, cand.r.PacketLoss, o.LossWeight)
+	if o.ThroughputProbe {
+		fmt.Fprintf(&b, " − %.1f Mbit/s × %g", cand.throughput, o.ThroughputWeight)
+	}
+	return b.String()
+}
+
+// throughput downloads o.ThroughputPath from r's meta server for at most
+// o.ThroughputDuration and returns the rate in Mbit/s, timed from the
+// response's headers so as to leave out the round trip.
+func (c *Client) throughput(ctx context.Context, r *Region, o ScoreOptions) (float64, error) {
+	meta := r.MetaServer()
+	if meta == nil {
+		return 0, fmt.Errorf("region %s has no meta server", r.Id)
+	}
+	ctx, cancel := context.WithTimeout(ctx, o.ThroughputDuration)
+	defer cancel()
+	path := o.ThroughputPath
+	if path == "" {
+		path = DefaultThroughputPath
+	}
+	url := fmt.Sprintf("https://%s:%d%s", meta.Ip, c.metaPort(), path)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.doPinned(req, meta.Cn)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("fetching %s: %s", path, resp.Status)
+	}
+	start := time.Now()
+	n, err := io.Copy(io.Discard, resp.Body)
+	elapsed := time.Since(start)
+	if err != nil && ctx.Err() == nil {
+		return 0, err
+	}
+	if n == 0 || elapsed <= 0 {
+		return 0, fmt.Errorf("nothing downloaded from %s", path)
+	}
+	return float64(n) * 8 / elapsed.Seconds() / 1e6, nil
+}
@@ -0,0 +1,120 @@
+package pia_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jdelkins/pia-tools/internal/pia"
+)
+
+func TestSelectRegion(t *testing.T) {
+	region := func(id string, ping time.Duration, loss float64) pia.Region {
+		return pia.Region{Id: id, PingTime: ping, PacketLoss: loss}
+	}
+	score := pia.ScoreOptions{Strategy: pia.StrategyScore, LossWeight: 20, StickyMargin: 20}
+	tests := []struct {
+		name     string
+		regions  []pia.Region
+		previous string
+		opts     pia.ScoreOptions
+		want     string
+	}{
+		{
+			name:    "best score without a previous region",
+			regions: []pia.Region{region("a", 50*time.Millisecond, 0), region("b", 20*time.Millisecond, 0)},
+			opts:    score,
+			want:    "b",
+		},
+		{
+			name:    "loss outweighs ping time",
+			regions: []pia.Region{region("a", 50*time.Millisecond, 0), region("b", 20*time.Millisecond, 2)},
+			opts:    score,
+			want:    "a",
+		},
+		{
+			name:     "previous region is the best",
+			regions:  []pia.Region{region("a", 50*time.Millisecond, 0), region("b", 20*time.Millisecond, 0)},
+			previous: "b",
+			opts:     score,
+			want:     "b",
+		},
+		{
+			name:     "previous region within the margin",
+			regions:  []pia.Region{region("a", 35*time.Millisecond, 0), region("b", 20*time.Millisecond, 0)},
+			previous: "a",
+			opts:     score,
+			want:     "a",
+		},
+		{
+			name:     "previous region at the margin",
+			regions:  []pia.Region{region("a", 40*time.Millisecond, 0), region("b", 20*time.Millisecond, 0)},
+			previous: "a",
+			opts:     score,
+			want:     "a",
+		},
+		{
+			name:     "previous region beyond the margin",
+			regions:  []pia.Region{region("a", 41*time.Millisecond, 0), region("b", 20*time.Millisecond, 0)},
+			previous: "a",
+			opts:     score,
+			want:     "b",
+		},
+		{
+			name:     "previous region beyond the margin through loss",
+			regions:  []pia.Region{region("a", 25*time.Millisecond, 1), region("b", 20*time.Millisecond, 0)},
+			previous: "a",
+			opts:     score,
+			want:     "b",
+		},
+		{
+			name:     "no margin",
+			regions:  []pia.Region{region("a", 21*time.Millisecond, 0), region("b", 20*time.Millisecond, 0)},
+			previous: "a",
+			opts:     pia.ScoreOptions{Strategy: pia.StrategyScore, LossWeight: 20},
+			want:     "b",
+		},
+		{
+			name:     "previous region unreachable",
+			regions:  []pia.Region{region("a", 0, 100), region("b", 20*time.Millisecond, 0)},
+			previous: "a",
+			opts:     score,
+			want:     "b",
+		},
+		{
+			name:     "ping strategy ignores the previous region",
+			regions:  []pia.Region{region("a", 21*time.Millisecond, 0), region("b", 20*time.Millisecond, 0)},
+			previous: "a",
+			opts:     pia.ScoreOptions{Strategy: pia.StrategyPing, StickyMargin: 20},
+			want:     "b",
+		},
+		{
+			name:    "none reachable",
+			regions: []pia.Region{region("a", 0, 100), region("b", 0, 100)},
+			opts:    score,
+			want:    "a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c pia.Client
+			r, sel, err := c.SelectRegion(context.Background(), tt.regions, tt.previous, tt.opts)
+			if err != nil {
+				t.Fatalf("SelectRegion: %v", err)
+			}
+			if r.Id != tt.want {
+				t.Errorf("chose %s, want %s: %s", r.Id, tt.want, sel.Reason)
+			}
+			if sel.Previous != tt.previous {
+				t.Errorf("previous region recorded as %q, want %q", sel.Previous, tt.previous)
+			}
+		})
+	}
+}
+
+func TestSelectRegionNoRegions(t *testing.T) {
+	var c pia.Client
+	if _, _, err := c.SelectRegion(context.Background(), nil, "", pia.ScoreOptions{}); err == nil {
+		t.Errorf("SelectRegion chose a region from none")
+	}
+}
@@ -0,0 +1,161 @@
+package pia
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ServerlistCacheFile is the name of the serverlist cache within
+// Client.ServerlistCacheDir.
+const ServerlistCacheFile = "serverlist.cache"
+
+// serverlistCache is the cached serverlist, along with what is needed to
+// revalidate it.
+type serverlistCache struct {
+	Fetched      time.Time `json:"fetched"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	// Body is the serverlist as downloaded, signature and all, so that it
+	// is verified again when read back.
+	Body []byte `json:"body"`
+}
+
+// serverlist returns the body of the serverlist: a line of JSON, followed by
+// a blank line and the base64-encoded signature of that JSON. With a cache
+// directory, a cached copy younger than ServerlistMaxAge is used as is; an
+// older one is revalidated, and used in place of the live list, with a
+// warning, if the serverlist can't be fetched. It also returns the age of the
+// list, which is zero if it was fetched, or revalidated, just now.
+func (c *Client) serverlist(ctx context.Context) ([]byte, time.Duration, error) {
+	cached := c.readServerlistCache()
+	if cached != nil && time.Since(cached.Fetched) < c.ServerlistMaxAge {
+		age := time.Since(cached.Fetched)
+		fmt.Fprintf(os.Stderr, "Using serverlist cached %v ago\n", age.Round(time.Second))
+		return cached.Body, age, nil
+	}
+
+	body, err := c.fetchServerlist(ctx, cached)
+	if err != nil {
+		if cached == nil || ctx.Err() != nil {
+			return nil, 0, err
+		}
+		age := time.Since(cached.Fetched)
+		fmt.Fprintf(os.Stderr, "Warning: %v; using serverlist cached %v ago\n", err, age.Round(time.Second))
+		return cached.Body, age, nil
+	}
+	return body, 0, nil
+}
+
+// fetchServerlist downloads the serverlist, or, if it has not changed since
+// cached was fetched, returns cached's body. The cache is updated either way.
+func (c *Client) fetchServerlist(ctx context.Context, cached *serverlistCache) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.serverlistURL(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, timeoutErr(req, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		cached.Fetched = time.Now()
+		c.writeServerlistCache(cached)
+		return cached.Body, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("fetching serverlist: %s", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, timeoutErr(req, err)
+	}
+	if err := c.verifyServerlist(body); err != nil {
+		return nil, err
+	}
+	c.writeServerlistCache(&serverlistCache{
+		Fetched:      time.Now(),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Body:         body,
+	})
+	return body, nil
+}
+
+// verifyServerlist checks the serverlist's RSA-SHA256 signature, unless
+// c.InsecureServerlist.
+func (c *Client) verifyServerlist(body []byte) error {
+	if c.InsecureServerlist {
+		return nil
+	}
+	data, sig, _ := bytes.Cut(body, []byte("\n"))
+	raw, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig)))
+	if err != nil || len(raw) == 0 {
+		return fmt.Errorf("serverlist is not signed")
+	}
+	hash := sha256.Sum256(data)
+	if err := rsa.VerifyPKCS1v15(c.serverlistKey(), crypto.SHA256, hash[:], raw); err != nil {
+		return fmt.Errorf("serverlist signature is invalid; it may have been tampered with")
+	}
+	return nil
+}
+
+// readServerlistCache returns the cached serverlist, or nil if there is none
+// usable.
+func (c *Client) readServerlistCache() *serverlistCache {
+	if c.ServerlistCacheDir == "" {
+		return nil
+	}
+	b, err := os.ReadFile(filepath.Join(c.ServerlistCacheDir, ServerlistCacheFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Warning: could not read serverlist cache: %v\n", err)
+		}
+		return nil
+	}
+	var cached serverlistCache
+	if err := json.Unmarshal(b, &cached); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: ignoring corrupt serverlist cache: %v\n", err)
+		return nil
+	}
+	if err := c.verifyServerlist(cached.Body); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: ignoring serverlist cache: %v\n", err)
+		return nil
+	}
+	return &cached
+}
+
+// writeServerlistCache replaces the cached serverlist. Failing to is not
+// fatal, since the serverlist is in hand.
+func (c *Client) writeServerlistCache(cached *serverlistCache) {
+	if c.ServerlistCacheDir == "" {
+		return
+	}
+	b, err := json.Marshal(cached)
+	if err == nil {
+		err = replaceFile(filepath.Join(c.ServerlistCacheDir, ServerlistCacheFile), b)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not save serverlist cache: %v\n", err)
+	}
+}
@@ -0,0 +1,260 @@
+package pia_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jdelkins/pia-tools/internal/pia"
+	"github.com/jdelkins/pia-tools/internal/pia/piatest"
+	"golang.org/x/sys/unix"
+)
+
+func TestServerlistSignature(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		tampered bool
+		key      *rsa.PublicKey
+		insecure bool
+		wantErr  string
+	}{
+		{name: "valid"},
+		{name: "tampered", tampered: true, wantErr: "tampered with"},
+		{name: "signed with another key", key: &otherKey.PublicKey, wantErr: "tampered with"},
+		{name: "tampered, but not checked", tampered: true, insecure: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := piatest.NewServer()
+			defer s.Close()
+			c := s.Client()
+			if tt.key != nil {
+				c.ServerlistKey = tt.key
+			}
+			c.InsecureServerlist = tt.insecure
+			s.TamperServerlist(tt.tampered)
+
+			regions, err := c.Regions(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Regions: error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Regions: %v", err)
+			}
+			if len(regions) != len(s.Regions()) {
+				t.Errorf("got %d regions, want %d", len(regions), len(s.Regions()))
+			}
+			if got := tampered(regions); got != tt.tampered {
+				t.Errorf("got a tampered serverlist: %v, want %v", got, tt.tampered)
+			}
+		})
+	}
+}
+
+// tampered reports whether any server in regions has the address that
+// piatest.Server.TamperServerlist substitutes.
+func tampered(regions []pia.Region) bool {
+	for _, r := range regions {
+		for _, servers := range r.Servers {
+			for _, srv := range servers {
+				if srv.Ip == "192.0.2.66" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// statusRecorder records the status of each response.
+type statusRecorder struct {
+	base     http.RoundTripper
+	statuses []int
+}
+
+func (r *statusRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.base.RoundTrip(req)
+	if err == nil {
+		r.statuses = append(r.statuses, resp.StatusCode)
+	}
+	return resp, err
+}
+
+func TestServerlistCache(t *testing.T) {
+	tests := []struct {
+		name   string
+		maxAge time.Duration
+		// between runs after the first fetch, which fills the cache.
+		between func(s *piatest.Server)
+		// status is that of the second request, or 0 if there should be
+		// none.
+		status  int
+		cached  bool
+		regions []string
+	}{
+		{
+			name:    "young cache is used as is",
+			maxAge:  time.Hour,
+			cached:  true,
+			regions: []string{"fake_pf", "fake_nopf"},
+		},
+		{
+			name:    "old cache is revalidated",
+			maxAge:  time.Nanosecond,
+			status:  http.StatusNotModified,
+			regions: []string{"fake_pf", "fake_nopf"},
+		},
+		{
+			name:   "changed list replaces old cache",
+			maxAge: time.Nanosecond,
+			between: func(s *piatest.Server) {
+				s.SetRegions([]pia.Region{s.NewRegion("fake_new", "Fake New", true)})
+			},
+			status:  http.StatusOK,
+			regions: []string{"fake_new"},
+		},
+		{
+			name:    "old cache is used when the fetch fails",
+			maxAge:  time.Nanosecond,
+			between: func(s *piatest.Server) { s.Fail(piatest.Serverlist, "ERROR", "Maintenance") },
+			status:  http.StatusServiceUnavailable,
+			cached:  true,
+			regions: []string{"fake_pf", "fake_nopf"},
+		},
+		{
+			name:   "old cache is used when the list is tampered with",
+			maxAge: time.Nanosecond,
+			between: func(s *piatest.Server) {
+				s.SetRegions([]pia.Region{s.NewRegion("fake_new", "Fake New", true)})
+				s.TamperServerlist(true)
+			},
+			status:  http.StatusOK,
+			cached:  true,
+			regions: []string{"fake_pf", "fake_nopf"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := piatest.NewServer()
+			defer s.Close()
+			c := s.Client()
+			rec := &statusRecorder{base: c.HTTPClient.Transport}
+			c.HTTPClient.Transport = rec
+			c.ServerlistCacheDir = t.TempDir()
+			c.ServerlistMaxAge = tt.maxAge
+			ctx := context.Background()
+
+			if _, age, err := c.RegionsWithAge(ctx); err != nil || age != 0 {
+				t.Fatalf("first RegionsWithAge: age %v, error %v", age, err)
+			}
+			if tt.between != nil {
+				tt.between(s)
+			}
+			regions, age, err := c.RegionsWithAge(ctx)
+			if err != nil {
+				t.Fatalf("RegionsWithAge: %v", err)
+			}
+
+			var status int
+			if len(rec.statuses) > 1 {
+				status = rec.statuses[1]
+			}
+			if status != tt.status {
+				t.Errorf("second request got status %d, want %d", status, tt.status)
+			}
+			if (age != 0) != tt.cached {
+				t.Errorf("serverlist age %v, want it from the cache: %v", age, tt.cached)
+			}
+			var ids []string
+			for _, r := range regions {
+				ids = append(ids, r.Id)
+			}
+			if !slices.Equal(ids, tt.regions) {
+				t.Errorf("got regions %v, want %v", ids, tt.regions)
+			}
+		})
+	}
+}
+
+// TestServerlistCacheWriteFails cuts the write of a new cache short, by way
+// of the file size limit, as if the disk had filled: the old cache must be
+// left whole, and no temporary file behind.
+func TestServerlistCacheWriteFails(t *testing.T) {
+	s := piatest.NewServer()
+	defer s.Close()
+	c := s.Client()
+	c.ServerlistCacheDir = t.TempDir()
+	c.ServerlistMaxAge = time.Nanosecond
+	ctx := context.Background()
+	if _, err := c.Regions(ctx); err != nil {
+		t.Fatalf("first Regions: %v", err)
+	}
+	path := filepath.Join(c.ServerlistCacheDir, pia.ServerlistCacheFile)
+	old, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading cache: %v", err)
+	}
+
+	// a longer serverlist, which won't fit
+	var regions []pia.Region
+	for i := range 100 {
+		regions = append(regions, s.NewRegion(fmt.Sprintf("fake_%d", i), fmt.Sprintf("Fake %d", i), true))
+	}
+	s.SetRegions(regions)
+	var limit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_FSIZE, &limit); err != nil {
+		t.Fatal(err)
+	}
+	small := limit
+	small.Cur = uint64(len(old)) + 1024
+	if err := unix.Setrlimit(unix.RLIMIT_FSIZE, &small); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.Regions(ctx)
+	if err := unix.Setrlimit(unix.RLIMIT_FSIZE, &limit); err != nil {
+		t.Fatal(err)
+	}
+	if err != nil || len(got) != len(regions) {
+		t.Fatalf("Regions got %d regions, error %v; want %d regions regardless of the cache", len(got), err, len(regions))
+	}
+
+	if b, err := os.ReadFile(path); err != nil || !bytes.Equal(b, old) {
+		t.Errorf("cache was not left as it was (error %v)", err)
+	}
+	entries, err := os.ReadDir(c.ServerlistCacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != pia.ServerlistCacheFile {
+			t.Errorf("left %s behind", e.Name())
+		}
+	}
+}
+
+func TestServerlistNoCacheFetchFails(t *testing.T) {
+	s := piatest.NewServer()
+	defer s.Close()
+	c := s.Client()
+	c.ServerlistCacheDir = t.TempDir()
+	s.Fail(piatest.Serverlist, "ERROR", "Maintenance")
+	if _, err := c.Regions(context.Background()); err == nil {
+		t.Errorf("Regions succeeded without a serverlist")
+	}
+}
@@ -1,6 +1,7 @@
 package pia
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -19,18 +20,27 @@ func (t Token) Valid() bool {
 }
 
 func (tun *Tunnel) NewToken(username string, password string) error {
+	return tun.NewTokenContext(context.Background(), username, password)
+}
+
+func (tun *Tunnel) NewTokenContext(ctx context.Context, username string, password string) error {
+	return DefaultClient.NewToken(ctx, tun, username, password)
+}
+
+// NewToken authenticates with PIA and stores a fresh access token in tun.
+func (c *Client) NewToken(ctx context.Context, tun *Tunnel, username string, password string) error {
 	vals := url.Values{
 		"username": {username},
 		"password": {password},
 	}
-	req, err := http.NewRequest("POST", "https://www.privateinternetaccess.com/api/client/v2/token", strings.NewReader(vals.Encode()))
+	req, err := http.NewRequestWithContext(ctx, "POST", c.tokenURL(), strings.NewReader(vals.Encode()))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return err
+		return timeoutErr(req, err)
 	}
 	defer resp.Body.Close()
 
@@ -40,7 +50,7 @@ func (tun *Tunnel) NewToken(username string, password string) error {
 		Message string `json:"message"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
-		return err
+		return timeoutErr(req, err)
 	}
 	if tokenResp.Token == "" {
 		if tokenResp.Status != "" || tokenResp.Message != "" {
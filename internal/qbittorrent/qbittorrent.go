@@ -0,0 +1,173 @@
+// Package qbittorrent sets the listening port of a qBittorrent client through
+// its Web API (https://github.com/qbittorrent/qBittorrent/wiki/WebUI-API-(qBittorrent-4.1)).
+package qbittorrent
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Client notifies a qBittorrent instance through its Web API.
+type Client struct {
+	// URL is the base URL of the Web UI, eg http://localhost:8080.
+	URL string
+	// Username and Password log in to the Web UI. If Username is empty, no
+	// login is attempted, which works when qBittorrent is configured to
+	// bypass authentication for the caller's address.
+	Username string
+	Password string
+	// CAFile, if not empty, names a PEM file of CA certificates to trust for
+	// an HTTPS Web UI, instead of the system roots.
+	CAFile string
+}
+
+// SetPort sets qBittorrent's listening port.
+func (c *Client) SetPort(ctx context.Context, port int) error {
+	s, err := c.login(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.logout(ctx)
+
+	// Disable "use different port on each startup", which would undo this
+	// the next time qBittorrent restarts.
+	prefs, err := json.Marshal(map[string]any{
+		"listen_port": port,
+		"random_port": false,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.call(ctx, "POST", "app/setPreferences", url.Values{"json": {string(prefs)}})
+	return err
+}
+
+// CurrentPort returns qBittorrent's current listening port.
+func (c *Client) CurrentPort(ctx context.Context) (int, error) {
+	s, err := c.login(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer s.logout(ctx)
+
+	body, err := s.call(ctx, "GET", "app/preferences", nil)
+	if err != nil {
+		return 0, err
+	}
+	var prefs struct {
+		ListenPort *int `json:"listen_port"`
+	}
+	if err := json.Unmarshal(body, &prefs); err != nil {
+		return 0, fmt.Errorf("could not decode qBittorrent preferences: %w", err)
+	}
+	if prefs.ListenPort == nil {
+		return 0, fmt.Errorf("qBittorrent preferences do not include listen_port")
+	}
+	return *prefs.ListenPort, nil
+}
+
+// session is a Web API client holding the SID cookie from a login.
+type session struct {
+	base     string
+	client   *http.Client
+	loggedIn bool
+}
+
+func (c *Client) login(ctx context.Context) (*session, error) {
+	base, err := url.Parse(strings.TrimSuffix(c.URL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("qBittorrent URL %q must be http or https", c.URL)
+	}
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &session{
+		base:   base.String(),
+		client: &http.Client{Jar: jar},
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		s.client.Transport = transport
+	}
+
+	if c.Username == "" {
+		return s, nil
+	}
+	body, err := s.call(ctx, "POST", "auth/login", url.Values{
+		"username": {c.Username},
+		"password": {c.Password},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// A bad username or password is reported with a 200 status.
+	if strings.TrimSpace(string(body)) != "Ok." {
+		return nil, fmt.Errorf("qBittorrent login failed for user %s", c.Username)
+	}
+	s.loggedIn = true
+	return s, nil
+}
+
+func (s *session) logout(ctx context.Context) {
+	if s.loggedIn {
+		s.call(ctx, "POST", "auth/logout", nil)
+	}
+}
+
+// call invokes the Web API method (eg "app/preferences"), with form
+// encoded if given, and returns the response body.
+func (s *session) call(ctx context.Context, verb, method string, form url.Values) ([]byte, error) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, verb, s.base+"/api/v2/"+method, body)
+	if err != nil {
+		return nil, err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	// qBittorrent rejects requests whose Referer or Origin do not match the
+	// Web UI's own address, as CSRF protection.
+	req.Header.Set("Referer", s.base)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return b, nil
+	case http.StatusForbidden:
+		return nil, fmt.Errorf("qBittorrent %s: forbidden (not logged in, or address banned after too many failed logins)", method)
+	default:
+		return nil, fmt.Errorf("qBittorrent %s: %s", method, resp.Status)
+	}
+}
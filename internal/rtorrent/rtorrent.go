@@ -1,13 +1,22 @@
 package rtorrent
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 
 	"github.com/kolo/xmlrpc"
 )
 
-func Notify(url string, port int) error {
-	client, err := xmlrpc.NewClient(url+"/RPC2", nil)
+// Client notifies an rtorrent instance through a reverse proxy fronting its
+// SCGI interface with XML-RPC at /RPC2.
+type Client struct {
+	// URL of the reverse proxy, without the /RPC2 part.
+	URL string
+}
+
+func (c *Client) SetPort(ctx context.Context, port int) error {
+	client, err := c.dial(ctx)
 	if err != nil {
 		return err
 	}
@@ -29,8 +38,8 @@ func Notify(url string, port int) error {
 	return nil
 }
 
-func Confirm(url string) (int, error) {
-	client, err := xmlrpc.NewClient(url+"/RPC2", nil)
+func (c *Client) CurrentPort(ctx context.Context) (int, error) {
+	client, err := c.dial(ctx)
 	if err != nil {
 		return -1, err
 	}
@@ -45,3 +54,17 @@ func Confirm(url string) (int, error) {
 	}
 	return port, nil
 }
+
+// dial returns an XML-RPC client whose requests are bound to ctx, which the
+// xmlrpc package does not otherwise support.
+func (c *Client) dial(ctx context.Context) (*xmlrpc.Client, error) {
+	return xmlrpc.NewClient(c.URL+"/RPC2", ctxTransport{ctx})
+}
+
+type ctxTransport struct {
+	ctx context.Context
+}
+
+func (t ctxTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return http.DefaultTransport.RoundTrip(req.WithContext(t.ctx))
+}
@@ -0,0 +1,52 @@
+// Package sdnotify implements the client side of systemd's service
+// notification protocol (sd_notify(3)), for Type=notify units.
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+	Watchdog = "WATCHDOG=1"
+)
+
+// Notify sends state (eg Ready, or "STATUS=...") to the service manager. It
+// does nothing, successfully, when not running under a Type=notify unit.
+func Notify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	// A leading '@' denotes an abstract socket, which the net package
+	// handles for us.
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Status is a convenience for Notify("STATUS=" + status).
+func Status(status string) error {
+	return Notify("STATUS=" + status)
+}
+
+// WatchdogInterval returns the time within which the service manager expects
+// each Watchdog notification, or 0 if it is not watching this process.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
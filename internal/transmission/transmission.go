@@ -7,19 +7,16 @@ import (
 	xm "github.com/hekmon/transmissionrpc/v3"
 )
 
-func Notify(server, username, password string, port int) error {
-	endpoint, err := url.Parse(server)
-	if err != nil {
-		return err
-	}
-
-	if username != "" {
-		endpoint.User = url.UserPassword(username, password)
-	}
-
-	config := xm.Config{}
+// Client notifies a transmission instance through its RPC endpoint.
+type Client struct {
+	// URL of the RPC endpoint, eg http://localhost:9091/transmission/rpc
+	URL      string
+	Username string
+	Password string
+}
 
-	client, err := xm.New(endpoint, &config)
+func (c *Client) SetPort(ctx context.Context, port int) error {
+	client, err := c.dial()
 	if err != nil {
 		return err
 	}
@@ -27,34 +24,36 @@ func Notify(server, username, password string, port int) error {
 	args := xm.SessionArguments{
 		PeerPort: &port64,
 	}
-	ctx := context.Background()
 	if err = client.SessionArgumentsSet(ctx, args); err != nil {
 		return err
 	}
 	return nil
 }
 
-func Confirm(server, username, password string) (int, error) {
-	endpoint, err := url.Parse(server)
+func (c *Client) CurrentPort(ctx context.Context) (int, error) {
+	client, err := c.dial()
 	if err != nil {
 		return 0, err
 	}
-
-	if username != "" {
-		endpoint.User = url.UserPassword(username, password)
+	args, err := client.SessionArgumentsGet(ctx, []string{"peer-port"})
+	if err != nil {
+		return 0, err
 	}
 
-	config := xm.Config{}
+	return int(*args.PeerPort), nil
+}
 
-	client, err := xm.New(endpoint, &config)
+func (c *Client) dial() (*xm.Client, error) {
+	endpoint, err := url.Parse(c.URL)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	ctx := context.Background()
-	args, err := client.SessionArgumentsGet(ctx, []string{"peer-port"})
-	if err != nil {
-		return 0, err
+
+	if c.Username != "" {
+		endpoint.User = url.UserPassword(c.Username, c.Password)
 	}
 
-	return int(*args.PeerPort), nil
+	config := xm.Config{}
+
+	return xm.New(endpoint, &config)
 }
@@ -0,0 +1,62 @@
+package wgkey
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+const KeyLen = 32
+
+// Key is a WireGuard Curve25519 key. Its string form is the base64 encoding
+// used by wireguard-tools and in WireGuard configuration files.
+type Key [KeyLen]byte
+
+// GeneratePrivate returns a new, clamped private key, equivalent to `wg genkey`.
+func GeneratePrivate() (Key, error) {
+	var k Key
+	if _, err := rand.Read(k[:]); err != nil {
+		return Key{}, fmt.Errorf("could not read random bytes: %w", err)
+	}
+	k.clamp()
+	return k, nil
+}
+
+// Parse decodes a base64-encoded key.
+func Parse(s string) (Key, error) {
+	var k Key
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return Key{}, fmt.Errorf("invalid key: %w", err)
+	}
+	if len(b) != KeyLen {
+		return Key{}, fmt.Errorf("invalid key: length %d, expected %d", len(b), KeyLen)
+	}
+	copy(k[:], b)
+	return k, nil
+}
+
+// Public derives the public key for private key k, equivalent to `wg pubkey`.
+func (k Key) Public() Key {
+	var pub Key
+	b, err := curve25519.X25519(k[:], curve25519.Basepoint)
+	if err != nil {
+		// X25519 only fails for low-order points, which the basepoint is not.
+		panic(fmt.Sprintf("wgkey: %v", err))
+	}
+	copy(pub[:], b)
+	return pub
+}
+
+func (k Key) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// clamp applies the Curve25519 private key bit twiddling that `wg genkey`
+// performs.
+func (k *Key) clamp() {
+	k[0] &= 248
+	k[31] = (k[31] & 127) | 64
+}
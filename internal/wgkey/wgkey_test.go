@@ -0,0 +1,60 @@
+package wgkey_test
+
+import (
+	"testing"
+
+	"github.com/jdelkins/pia-tools/internal/wgkey"
+)
+
+func TestPublic(t *testing.T) {
+	// The key pair is Alice's from RFC 7748, section 6.1; `wg pubkey`
+	// derives the same public key from the private one.
+	const pub = "hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTmo="
+	tests := []struct {
+		name    string
+		private string
+	}{
+		{"as given", "dwdtCnMYpX08FsFyUbJmRd9ML4frwJkqsXf7pR25LCo="},
+		// The RFC's key is not clamped; clamping it must not change the
+		// public key, as `wg pubkey` clamps before deriving it.
+		{"clamped", "cAdtCnMYpX08FsFyUbJmRd9ML4frwJkqsXf7pR25LGo="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := wgkey.Parse(tt.private)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := k.Public().String(); got != pub {
+				t.Errorf("Public() = %s, want %s", got, pub)
+			}
+		})
+	}
+}
+
+func TestGeneratePrivate(t *testing.T) {
+	for i := 0; i < 64; i++ {
+		k, err := wgkey.GeneratePrivate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k[0]&7 != 0 || k[31]&128 != 0 || k[31]&64 == 0 {
+			t.Fatalf("key %s is not clamped", k)
+		}
+		if p, err := wgkey.Parse(k.String()); err != nil || p != k {
+			t.Fatalf("Parse(%s) = %s, %v", k, p, err)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"not base64!",
+		"dwdtCnMYpX08FsFyUbJmRd9ML4frwJkqsXf7pR25",
+	} {
+		if _, err := wgkey.Parse(s); err == nil {
+			t.Errorf("Parse(%q) succeeded", s)
+		}
+	}
+}
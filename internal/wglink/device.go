@@ -0,0 +1,57 @@
+package wglink
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/jdelkins/pia-tools/internal/netlink"
+	"github.com/jdelkins/pia-tools/internal/wgkey"
+	"golang.org/x/sys/unix"
+)
+
+// peer is the single peer of a PIA tunnel.
+type peer struct {
+	publicKey  wgkey.Key
+	endpoint   *net.UDPAddr
+	keepalive  time.Duration
+	allowedIPs []*net.IPNet
+}
+
+// sockaddrIn4 encodes a struct sockaddr_in.
+func sockaddrIn4(addr *net.UDPAddr) []byte {
+	b := make([]byte, unix.SizeofSockaddrInet4)
+	binary.NativeEndian.PutUint16(b[0:2], unix.AF_INET)
+	binary.BigEndian.PutUint16(b[2:4], uint16(addr.Port))
+	copy(b[4:8], addr.IP.To4())
+	return b
+}
+
+// configureDevice sets the interface's private key and replaces its peers
+// with p, like `wg setconf`.
+func configureDevice(c *netlink.Conn, family uint16, index int, key wgkey.Key, p peer) error {
+	e := netlink.NewEncoder(netlink.GenlHeader(unix.WG_CMD_SET_DEVICE, unix.WG_GENL_VERSION))
+	e.Uint32(unix.WGDEVICE_A_IFINDEX, uint32(index))
+	e.Bytes(unix.WGDEVICE_A_PRIVATE_KEY, key[:])
+	e.Uint32(unix.WGDEVICE_A_FLAGS, unix.WGDEVICE_F_REPLACE_PEERS)
+	e.Nest(unix.WGDEVICE_A_PEERS)
+	e.Nest(0)
+	e.Bytes(unix.WGPEER_A_PUBLIC_KEY, p.publicKey[:])
+	e.Uint32(unix.WGPEER_A_FLAGS, unix.WGPEER_F_REPLACE_ALLOWEDIPS)
+	e.Bytes(unix.WGPEER_A_ENDPOINT, sockaddrIn4(p.endpoint))
+	e.Uint16(unix.WGPEER_A_PERSISTENT_KEEPALIVE_INTERVAL, uint16(p.keepalive/time.Second))
+	e.Nest(unix.WGPEER_A_ALLOWEDIPS)
+	for _, n := range p.allowedIPs {
+		ones, _ := n.Mask.Size()
+		e.Nest(0)
+		e.Uint16(unix.WGALLOWEDIP_A_FAMILY, unix.AF_INET)
+		e.Bytes(unix.WGALLOWEDIP_A_IPADDR, n.IP.To4())
+		e.Uint8(unix.WGALLOWEDIP_A_CIDR_MASK, uint8(ones))
+		e.End()
+	}
+	e.End()
+	e.End()
+	e.End()
+	_, err := c.Execute(family, 0, e.Encode())
+	return err
+}
@@ -0,0 +1,87 @@
+package wglink
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/jdelkins/pia-tools/internal/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// LastHandshake returns the time of the most recent handshake with the peer
+// of the WireGuard interface ifname, like `wg show ifname latest-handshakes`.
+// It is the zero time if there has been none. Requires CAP_NET_ADMIN.
+func LastHandshake(ifname string) (time.Time, error) {
+	gn, err := netlink.Dial(unix.NETLINK_GENERIC)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer gn.Close()
+	family, err := gn.ResolveFamily(unix.WG_GENL_NAME)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	e := netlink.NewEncoder(netlink.GenlHeader(unix.WG_CMD_GET_DEVICE, unix.WG_GENL_VERSION))
+	e.String(unix.WGDEVICE_A_IFNAME, ifname)
+	msgs, err := gn.Execute(family, unix.NLM_F_DUMP, e.Encode())
+	if err != nil {
+		if netlink.IsNotExist(err) {
+			return time.Time{}, fmt.Errorf("no WireGuard interface %s", ifname)
+		}
+		return time.Time{}, fmt.Errorf("could not query WireGuard interface %s: %w", ifname, err)
+	}
+
+	var latest time.Time
+	peers := 0
+	for _, m := range msgs {
+		if len(m.Data) < unix.GENL_HDRLEN {
+			continue
+		}
+		attrs, err := netlink.ParseAttrs(m.Data[unix.GENL_HDRLEN:])
+		if err != nil {
+			return time.Time{}, err
+		}
+		for _, a := range attrs {
+			if a.Type != unix.WGDEVICE_A_PEERS {
+				continue
+			}
+			list, err := a.Nested()
+			if err != nil {
+				return time.Time{}, err
+			}
+			for _, p := range list {
+				peers++
+				pattrs, err := p.Nested()
+				if err != nil {
+					return time.Time{}, err
+				}
+				for _, pa := range pattrs {
+					if pa.Type == unix.WGPEER_A_LAST_HANDSHAKE_TIME {
+						if t := timespec(pa.Data); t.After(latest) {
+							latest = t
+						}
+					}
+				}
+			}
+		}
+	}
+	if peers == 0 {
+		return time.Time{}, fmt.Errorf("WireGuard interface %s has no peer", ifname)
+	}
+	return latest, nil
+}
+
+// timespec decodes a struct __kernel_timespec; all zeroes is the zero time.
+func timespec(b []byte) time.Time {
+	if len(b) < 16 {
+		return time.Time{}
+	}
+	sec := int64(binary.NativeEndian.Uint64(b[0:8]))
+	nsec := int64(binary.NativeEndian.Uint64(b[8:16]))
+	if sec == 0 && nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, nsec)
+}
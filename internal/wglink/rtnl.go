@@ -0,0 +1,193 @@
+package wglink
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/jdelkins/pia-tools/internal/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// ifInfoMsg encodes a struct ifinfomsg.
+func ifInfoMsg(index int32, flags, change uint32) []byte {
+	b := make([]byte, unix.SizeofIfInfomsg)
+	b[0] = unix.AF_UNSPEC
+	binary.NativeEndian.PutUint32(b[4:8], uint32(index))
+	binary.NativeEndian.PutUint32(b[8:12], flags)
+	binary.NativeEndian.PutUint32(b[12:16], change)
+	return b
+}
+
+// ifAddrMsg encodes a struct ifaddrmsg.
+func ifAddrMsg(prefixlen uint8, scope uint8, index int32) []byte {
+	b := make([]byte, unix.SizeofIfAddrmsg)
+	b[0] = unix.AF_INET
+	b[1] = prefixlen
+	b[3] = scope
+	binary.NativeEndian.PutUint32(b[4:8], uint32(index))
+	return b
+}
+
+// rtMsg encodes a struct rtmsg for an IPv4 unicast route.
+func rtMsg(dstLen uint8, table uint32, scope uint8, flags uint32) []byte {
+	b := make([]byte, unix.SizeofRtMsg)
+	b[0] = unix.AF_INET
+	b[1] = dstLen
+	if table < 256 {
+		b[4] = uint8(table)
+	} else {
+		b[4] = unix.RT_TABLE_UNSPEC
+	}
+	b[5] = unix.RTPROT_STATIC
+	b[6] = scope
+	b[7] = unix.RTN_UNICAST
+	binary.NativeEndian.PutUint32(b[8:12], flags)
+	return b
+}
+
+func ip4(s string) (net.IP, error) {
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("not an IPv4 address: %q", s)
+	}
+	return ip, nil
+}
+
+// createWireGuardLink creates a new WireGuard interface named name.
+func createWireGuardLink(c *netlink.Conn, name string) error {
+	e := netlink.NewEncoder(ifInfoMsg(0, 0, 0))
+	e.String(unix.IFLA_IFNAME, name)
+	e.Nest(unix.IFLA_LINKINFO)
+	e.String(unix.IFLA_INFO_KIND, "wireguard")
+	e.End()
+	_, err := c.Execute(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, e.Encode())
+	return err
+}
+
+func deleteLink(c *netlink.Conn, index int) error {
+	_, err := c.Execute(unix.RTM_DELLINK, 0, ifInfoMsg(int32(index), 0, 0))
+	return err
+}
+
+func setLinkUp(c *netlink.Conn, index int) error {
+	_, err := c.Execute(unix.RTM_NEWLINK, 0, ifInfoMsg(int32(index), unix.IFF_UP, unix.IFF_UP))
+	return err
+}
+
+func setLinkMTU(c *netlink.Conn, index int, mtu int) error {
+	e := netlink.NewEncoder(ifInfoMsg(int32(index), 0, 0))
+	e.Uint32(unix.IFLA_MTU, uint32(mtu))
+	_, err := c.Execute(unix.RTM_NEWLINK, 0, e.Encode())
+	return err
+}
+
+// addAddress assigns ip/32 to the interface, replacing it if present.
+func addAddress(c *netlink.Conn, index int, ip net.IP) error {
+	e := netlink.NewEncoder(ifAddrMsg(32, unix.RT_SCOPE_UNIVERSE, int32(index)))
+	e.Bytes(unix.IFA_LOCAL, ip)
+	e.Bytes(unix.IFA_ADDRESS, ip)
+	_, err := c.Execute(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, e.Encode())
+	return err
+}
+
+// route describes an IPv4 route.
+type route struct {
+	dst *net.IPNet
+	gw  net.IP // nil for a link-scope route
+	// onlink marks a gateway that is not on a connected subnet, such as the
+	// server's virtual IP, which is only reachable through the tunnel.
+	onlink bool
+	table  uint32
+	metric uint32
+	// replace allows the route to take the place of an existing one to the
+	// same destination; otherwise adding it fails if there is one.
+	replace bool
+}
+
+func (r route) String() string {
+	s := r.dst.String()
+	if r.gw != nil {
+		s += " via " + r.gw.String()
+	}
+	return s
+}
+
+// addRoute installs r via the interface.
+func addRoute(c *netlink.Conn, index int, r route) error {
+	ones, _ := r.dst.Mask.Size()
+	scope := uint8(unix.RT_SCOPE_LINK)
+	var flags uint32
+	if r.gw != nil {
+		scope = unix.RT_SCOPE_UNIVERSE
+	}
+	if r.onlink {
+		flags = unix.RTNH_F_ONLINK
+	}
+	e := netlink.NewEncoder(rtMsg(uint8(ones), r.table, scope, flags))
+	e.Bytes(unix.RTA_DST, r.dst.IP.To4())
+	if r.gw != nil {
+		e.Bytes(unix.RTA_GATEWAY, r.gw.To4())
+	}
+	e.Uint32(unix.RTA_OIF, uint32(index))
+	if r.metric != 0 {
+		e.Uint32(unix.RTA_PRIORITY, r.metric)
+	}
+	if r.table >= 256 {
+		e.Uint32(unix.RTA_TABLE, r.table)
+	}
+	create := uint16(unix.NLM_F_CREATE | unix.NLM_F_EXCL)
+	if r.replace {
+		create = unix.NLM_F_CREATE | unix.NLM_F_REPLACE
+	}
+	_, err := c.Execute(unix.RTM_NEWROUTE, create, e.Encode())
+	return err
+}
+
+// deleteRoute removes the route to r.dst in r.table with r.metric, whichever
+// interface it goes through.
+func deleteRoute(c *netlink.Conn, r route) error {
+	ones, _ := r.dst.Mask.Size()
+	e := netlink.NewEncoder(rtMsg(uint8(ones), r.table, unix.RT_SCOPE_NOWHERE, 0))
+	e.Bytes(unix.RTA_DST, r.dst.IP.To4())
+	if r.metric != 0 {
+		e.Uint32(unix.RTA_PRIORITY, r.metric)
+	}
+	if r.table >= 256 {
+		e.Uint32(unix.RTA_TABLE, r.table)
+	}
+	_, err := c.Execute(unix.RTM_DELROUTE, 0, e.Encode())
+	return err
+}
+
+// lookupRoute asks the kernel how it would currently route to ip, returning
+// the gateway, if any, and the outgoing interface.
+func lookupRoute(c *netlink.Conn, ip net.IP) (gw net.IP, index int, err error) {
+	e := netlink.NewEncoder(rtMsg(32, unix.RT_TABLE_UNSPEC, 0, 0))
+	e.Bytes(unix.RTA_DST, ip.To4())
+	msgs, err := c.Execute(unix.RTM_GETROUTE, 0, e.Encode())
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, m := range msgs {
+		if m.Header.Type != unix.RTM_NEWROUTE || len(m.Data) < unix.SizeofRtMsg {
+			continue
+		}
+		attrs, err := netlink.ParseAttrs(m.Data[unix.SizeofRtMsg:])
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, a := range attrs {
+			switch a.Type {
+			case unix.RTA_GATEWAY:
+				gw = net.IP(a.Data).To4()
+			case unix.RTA_OIF:
+				index = int(a.Uint32())
+			}
+		}
+		if index != 0 {
+			return gw, index, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("no route to %s", ip)
+}
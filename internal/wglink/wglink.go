@@ -0,0 +1,187 @@
+// Package wglink brings up a PIA WireGuard tunnel directly through the kernel's
+// netlink interfaces, as an alternative to rendering systemd-networkd files.
+package wglink
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jdelkins/pia-tools/internal/netlink"
+	"github.com/jdelkins/pia-tools/internal/pia"
+	"github.com/jdelkins/pia-tools/internal/wgkey"
+	"golang.org/x/sys/unix"
+)
+
+const DefaultKeepalive = 25 * time.Second
+
+// Options tune how Apply configures the interface and its routes.
+type Options struct {
+	// Table is the routing table in which routes are installed; 0 means
+	// the main table.
+	Table uint32
+	// Metric is the priority of the installed routes; 0 leaves the kernel
+	// default.
+	Metric uint32
+	// DefaultRoute installs a 0.0.0.0/0 route through the tunnel, along
+	// with a route to the server's endpoint by way of the gateway it is
+	// reached through now, so that the tunnel's own packets stay out of it.
+	// The default route is never put in place of an existing one in Table;
+	// in the main table, that means giving it a Metric of its own. Without
+	// it, only routes to the server's virtual IP and the DNS servers are
+	// added.
+	DefaultRoute bool
+	// Keepalive is the peer's persistent keepalive interval; 0 means
+	// DefaultKeepalive.
+	Keepalive time.Duration
+	// MTU of the interface; 0 leaves the kernel default.
+	MTU int
+	// PreviousEndpointRoute is the endpoint route recorded by the last
+	// Apply to this interface, as read from the cache. It is removed, so
+	// that routes to servers no longer in use do not pile up.
+	PreviousEndpointRoute *pia.HostRoute
+}
+
+// Apply (re)creates the WireGuard interface tun.Interface and configures it
+// from tun: private key, the PIA server as the sole peer, the peer IP address,
+// and routes equivalent to the stock pia.network template. Any existing
+// interface of the same name is deleted first. The route to the server's
+// endpoint, if one is added, is recorded in tun.EndpointRoute. Requires
+// CAP_NET_ADMIN.
+func Apply(tun *pia.Tunnel, opts Options) error {
+	key, err := wgkey.Parse(tun.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("private key: %w", err)
+	}
+	serverKey, err := wgkey.Parse(tun.ServerPubkey)
+	if err != nil {
+		return fmt.Errorf("server public key: %w", err)
+	}
+	endpointIP, err := ip4(tun.ServerIp)
+	if err != nil {
+		return fmt.Errorf("server ip: %w", err)
+	}
+	vip, err := ip4(tun.ServerVip)
+	if err != nil {
+		return fmt.Errorf("server vip: %w", err)
+	}
+	peerIP, err := ip4(tun.PeerIp)
+	if err != nil {
+		return fmt.Errorf("peer ip: %w", err)
+	}
+	if opts.Table == 0 {
+		opts.Table = unix.RT_TABLE_MAIN
+	}
+	if opts.Keepalive == 0 {
+		opts.Keepalive = DefaultKeepalive
+	}
+
+	routes := []route{{dst: host(vip), table: opts.Table, metric: opts.Metric}}
+	for _, d := range tun.DnsServers {
+		ip, err := ip4(d)
+		if err != nil {
+			return fmt.Errorf("dns server: %w", err)
+		}
+		routes = append(routes, route{dst: host(ip), gw: vip, onlink: true, table: opts.Table, metric: opts.Metric})
+	}
+	if opts.DefaultRoute {
+		routes = append(routes, route{dst: &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}, gw: vip, onlink: true, table: opts.Table, metric: opts.Metric})
+	}
+
+	rt, err := netlink.Dial(unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer rt.Close()
+	gn, err := netlink.Dial(unix.NETLINK_GENERIC)
+	if err != nil {
+		return err
+	}
+	defer gn.Close()
+	family, err := gn.ResolveFamily(unix.WG_GENL_NAME)
+	if err != nil {
+		return err
+	}
+
+	if ifc, err := net.InterfaceByName(tun.Interface); err == nil {
+		if err := deleteLink(rt, ifc.Index); err != nil && !netlink.IsNotExist(err) {
+			return fmt.Errorf("could not delete existing interface %s: %w", tun.Interface, err)
+		}
+	}
+	// Only now that the old interface, and whatever routes went through it,
+	// are gone can the route to the endpoint be looked up.
+	if tun.EndpointRoute, err = replaceEndpointRoute(rt, opts.PreviousEndpointRoute, endpointIP, opts); err != nil {
+		return err
+	}
+	if err := createWireGuardLink(rt, tun.Interface); err != nil {
+		return fmt.Errorf("could not create interface %s: %w", tun.Interface, err)
+	}
+	ifc, err := net.InterfaceByName(tun.Interface)
+	if err != nil {
+		return err
+	}
+
+	p := peer{
+		publicKey:  serverKey,
+		endpoint:   &net.UDPAddr{IP: endpointIP, Port: tun.ServerPort},
+		keepalive:  opts.Keepalive,
+		allowedIPs: []*net.IPNet{{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}},
+	}
+	if err := configureDevice(gn, family, ifc.Index, key, p); err != nil {
+		return fmt.Errorf("could not configure WireGuard on %s: %w", tun.Interface, err)
+	}
+	if opts.MTU != 0 {
+		if err := setLinkMTU(rt, ifc.Index, opts.MTU); err != nil {
+			return fmt.Errorf("could not set MTU on %s: %w", tun.Interface, err)
+		}
+	}
+	if err := addAddress(rt, ifc.Index, peerIP); err != nil {
+		return fmt.Errorf("could not add address %s to %s: %w", peerIP, tun.Interface, err)
+	}
+	if err := setLinkUp(rt, ifc.Index); err != nil {
+		return fmt.Errorf("could not bring up %s: %w", tun.Interface, err)
+	}
+	for _, r := range routes {
+		if err := addRoute(rt, ifc.Index, r); err != nil {
+			if netlink.IsExist(err) {
+				return fmt.Errorf("could not add route %s (table %d), since there is one already; choose another metric or table: %w", r, r.table, err)
+			}
+			return fmt.Errorf("could not add route %s (table %d): %w", r, r.table, err)
+		}
+	}
+	return nil
+}
+
+func host(ip net.IP) *net.IPNet {
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+}
+
+// replaceEndpointRoute removes prev, if not nil, then, if opts.DefaultRoute is
+// set, routes to endpoint by way of the gateway it is reached through now,
+// returning the route added.
+func replaceEndpointRoute(c *netlink.Conn, prev *pia.HostRoute, endpoint net.IP, opts Options) (*pia.HostRoute, error) {
+	if prev != nil {
+		dst, err := ip4(prev.Dst)
+		if err != nil {
+			return nil, fmt.Errorf("previous endpoint route: %w", err)
+		}
+		r := route{dst: host(dst), table: prev.Table, metric: prev.Metric}
+		if err := deleteRoute(c, r); err != nil && !netlink.IsNotExist(err) {
+			return nil, fmt.Errorf("could not remove route %s (table %d): %w", r, r.table, err)
+		}
+	}
+	if !opts.DefaultRoute {
+		return nil, nil
+	}
+	gw, index, err := lookupRoute(c, endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("could not find the route to server %s: %w", endpoint, err)
+	}
+	// The route is replaced if present, as it will be when the same server
+	// is chosen again without the previous route having been recorded.
+	r := route{dst: host(endpoint), gw: gw, table: opts.Table, metric: opts.Metric, replace: true}
+	if err := addRoute(c, index, r); err != nil {
+		return nil, fmt.Errorf("could not add route %s (table %d): %w", r, r.table, err)
+	}
+	return &pia.HostRoute{Dst: endpoint.String(), Table: opts.Table, Metric: opts.Metric}, nil
+}
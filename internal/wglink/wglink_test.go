@@ -0,0 +1,139 @@
+package wglink
+
+import (
+	"net"
+	"testing"
+
+	"github.com/jdelkins/pia-tools/internal/netlink"
+	"github.com/jdelkins/pia-tools/internal/pia"
+	"golang.org/x/sys/unix"
+)
+
+// emptyNetns dials rtnetlink for a test that changes routes, skipping the test
+// unless it runs in a network namespace of its own, eg under unshare -rn, so
+// that the host's routes are never touched. The loopback interface is brought
+// up and given 10.0.0.0/24, through which the tests route.
+func emptyNetns(t *testing.T) *netlink.Conn {
+	t.Helper()
+	ifcs, err := net.Interfaces()
+	if err != nil || len(ifcs) != 1 || ifcs[0].Flags&net.FlagLoopback == 0 {
+		t.Skip("needs an empty network namespace; run under unshare -rn")
+	}
+	c, err := netlink.Dial(unix.NETLINK_ROUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if err := setLinkUp(c, ifcs[0].Index); err != nil {
+		t.Skipf("cannot configure the network namespace: %v", err)
+	}
+	lan := route{dst: &net.IPNet{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(24, 32)}, table: unix.RT_TABLE_MAIN, replace: true}
+	if err := addRoute(c, ifcs[0].Index, lan); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// routed reports whether there is a route to dst in table.
+func routed(t *testing.T, c *netlink.Conn, dst string, table uint32) bool {
+	t.Helper()
+	r := route{dst: host(net.ParseIP(dst).To4()), table: table}
+	err := deleteRoute(c, r)
+	if netlink.IsNotExist(err) {
+		return false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	// put it back, through loopback as the tests' routes all are
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := addRoute(c, lo.Index, r); err != nil {
+		t.Fatal(err)
+	}
+	return true
+}
+
+func TestReplaceEndpointRoute(t *testing.T) {
+	const table = 100
+	tests := []struct {
+		name string
+		// before is the endpoint routed to by a previous Apply, if any.
+		before       string
+		endpoint     string
+		defaultRoute bool
+		want         *pia.HostRoute
+	}{
+		{
+			name:         "first tunnel",
+			endpoint:     "10.0.0.5",
+			defaultRoute: true,
+			want:         &pia.HostRoute{Dst: "10.0.0.5", Table: table},
+		},
+		{
+			name:         "another server",
+			before:       "10.0.0.5",
+			endpoint:     "10.0.0.6",
+			defaultRoute: true,
+			want:         &pia.HostRoute{Dst: "10.0.0.6", Table: table},
+		},
+		{
+			name:         "same server",
+			before:       "10.0.0.5",
+			endpoint:     "10.0.0.5",
+			defaultRoute: true,
+			want:         &pia.HostRoute{Dst: "10.0.0.5", Table: table},
+		},
+		{
+			name:     "no default route any more",
+			before:   "10.0.0.5",
+			endpoint: "10.0.0.6",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := emptyNetns(t)
+			opts := Options{Table: table, DefaultRoute: tt.defaultRoute}
+			var prev *pia.HostRoute
+			if tt.before != "" {
+				var err error
+				prev, err = replaceEndpointRoute(c, nil, net.ParseIP(tt.before).To4(), Options{Table: table, DefaultRoute: true})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := replaceEndpointRoute(c, prev, net.ParseIP(tt.endpoint).To4(), opts)
+			if err != nil {
+				t.Fatalf("replaceEndpointRoute: %v", err)
+			}
+			switch {
+			case (got == nil) != (tt.want == nil):
+				t.Fatalf("recorded route %+v, want %+v", got, tt.want)
+			case got != nil && *got != *tt.want:
+				t.Errorf("recorded route %+v, want %+v", *got, *tt.want)
+			}
+			for _, dst := range []string{tt.before, tt.endpoint} {
+				want := tt.want != nil && dst == tt.want.Dst
+				if dst != "" && routed(t, c, dst, table) != want {
+					t.Errorf("route to %s present: %v, want %v", dst, !want, want)
+				}
+			}
+
+			// Remove the route, so that the next test starts without it.
+			if _, err := replaceEndpointRoute(c, got, nil, Options{}); err != nil {
+				t.Fatalf("removing %+v: %v", got, err)
+			}
+		})
+	}
+}
+
+func TestReplaceEndpointRouteAlreadyGone(t *testing.T) {
+	c := emptyNetns(t)
+	prev := &pia.HostRoute{Dst: "10.0.0.7", Table: 100}
+	if _, err := replaceEndpointRoute(c, prev, net.ParseIP("10.0.0.5").To4(), Options{}); err != nil {
+		t.Errorf("removing a route that is gone: %v", err)
+	}
+}
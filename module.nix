@@ -21,9 +21,28 @@ let
 
   getIp = ''${pkgs.jq}/bin/jq -r .server_ip <${cacheFile} | ${pkgs.coreutils}/bin/tr -d \\n'';
 
+  portForwardArgs = lib.concatStringsSep " " (
+    [
+      "--cache-dir ${cfg.cacheDir}"
+      "--if-name ${cfg.ifname}"
+    ]
+    ++ lib.optionals (cfg.nftSet != null) [ ''--nft-set="${cfg.nftSet}"'' ]
+    ++ lib.optionals (cfg.nftDnat != null) [ "--nft-dnat=${cfg.nftDnat}" ]
+  );
+
+  # The kill switch exempts the service user, so that it can reset the tunnel.
+  killSwitchArgs = lib.optionalString cfg.killSwitch (
+    " --killswitch --killswitch-user=${cfg.user}"
+    + lib.optionalString (
+      cfg.killSwitchAllow != null
+    ) " --killswitch-allow=${lib.concatStringsSep "," cfg.killSwitchAllow}"
+  );
+
   serviceEnvFile = pkgs.writeText "service_params.sh" ''
     ${lib.optionalString (cfg.transmissionUrl != null) "TRANSMISSION=${cfg.transmissionUrl}"}
     ${lib.optionalString (cfg.rTorrentUrl != null) "RTORRENT=${cfg.rTorrentUrl}"}
+    ${lib.optionalString (cfg.qbittorrentUrl != null) "QBITTORRENT=${cfg.qbittorrentUrl}"}
+    ${lib.optionalString (cfg.delugeUrl != null) "DELUGE=${cfg.delugeUrl}"}
   '';
 in
 {
@@ -68,6 +87,20 @@ in
       example = "ca_toronto";
     };
 
+    probe = mkOption {
+      description = ''
+        How pia-setup-tunnel measures the latency to regions when choosing one automatically. The
+        hardened service can't open raw sockets, and ICMP datagram sockets need
+        net.ipv4.ping_group_range, so the default times TCP handshakes instead.
+      '';
+      type = types.enum [
+        "icmp"
+        "udp-unprivileged"
+        "tcp-connect"
+      ];
+      default = "tcp-connect";
+    };
+
     rTorrentUrl = mkOption {
       description = "URL to rTorrent SCGI endpoint";
       type = types.nullOr types.str;
@@ -86,6 +119,27 @@ in
       example = "http://192.168.100.100:9091/rpc/";
     };
 
+    qbittorrentUrl = mkOption {
+      description = ''
+        qBittorrent Web UI URL. If your qBittorrent server requires
+        a username and password, set them in config.services.pia-tools.envFile, with
+        the variables QBITTORRENT_USERNAME and QBITTORRENT_PASSWORD.
+      '';
+      type = types.nullOr types.str;
+      default = null;
+      example = "http://192.168.100.102:8080";
+    };
+
+    delugeUrl = mkOption {
+      description = ''
+        deluge-web URL. Set its password in config.services.pia-tools.envFile, with
+        the variable DELUGE_PASSWORD.
+      '';
+      type = types.nullOr types.str;
+      default = null;
+      example = "http://192.168.100.103:8112";
+    };
+
     envFile = mkOption {
       description = ''
         Required. Path to file setting environment variables to be used
@@ -100,6 +154,11 @@ in
 
            TRANSMISSION_USERNAME
            TRANSMISSION_PASSWORD
+           QBITTORRENT_USERNAME
+           QBITTORRENT_PASSWORD
+           QBITTORRENT_CA
+           DELUGE_PASSWORD
+           PIA_NOTIFY (space-separated client+url list, see pia-portforward --help)
       '';
       type = types.path;
     };
@@ -139,6 +198,7 @@ in
       description = ''
         Script to run when the wireguard endpoint is established, ostensibly to add the ip to a firewall passlist.
         The script will be called with the ip as the only argument. Set to null to ignore.
+        See killSwitch for a built-in alternative.
       '';
       type = with types; nullOr path;
       default = null;
@@ -149,12 +209,80 @@ in
       '';
     };
 
+    killSwitch = mkOption {
+      description = ''
+        Install an nftables kill switch (the "inet pia_killswitch" table) that drops traffic leaving other
+        than through the tunnel, to its endpoint, to its DNS servers or to killSwitchAllow. It is replaced
+        whenever the tunnel is reset, so, unlike whitelistScript, there is no passlist to maintain.
+      '';
+      type = types.bool;
+      default = false;
+    };
+
+    killSwitchAllow = mkOption {
+      description = "Destinations (CIDRs) the kill switch allows regardless, e.g. the LAN. null means the private, link-local and multicast ranges.";
+      type = with types; nullOr (listOf str);
+      default = null;
+      example = [ "192.168.1.0/24" ];
+    };
+
+    healthCheck = mkOption {
+      description = ''
+        Watch the tunnel with a long-running `pia-healthcheck --watch` service, which checks the WireGuard
+        handshake and pings through the tunnel, and reset the tunnel (to a newly selected server) when it
+        stops working.
+      '';
+      type = types.bool;
+      default = false;
+    };
+
+    healthCheckServiceName = mkOption {
+      description = "Name of systemd service for the pia-tools tunnel health check (only relevant if healthCheck is enabled).";
+      type = types.str;
+      default = "pia-healthcheck-${cfg.ifname}";
+    };
+
     portForwarding = mkOption {
       description = "whether to request a port forwarding assignment from PIA.";
       type = types.bool;
       default = false;
     };
 
+    portForwardDaemon = mkOption {
+      description = ''
+        Keep the port forwarding assignment alive with a long-running `pia-portforward daemon` service
+        instead of a oneshot service triggered by refreshTimerConfig.
+      '';
+      type = types.bool;
+      default = false;
+    };
+
+    nftSet = mkOption {
+      description = ''
+        nftables set (of type inet_service), given as "family table set", in which to keep the forwarded port
+        as the only element, so that firewall rules can refer to it.
+      '';
+      type = types.nullOr types.str;
+      default = null;
+      example = "inet filter pia_ports";
+    };
+
+    nftDnat = mkOption {
+      description = ''
+        Internal host (host or host:port) to which incoming traffic for the forwarded port is DNATed, using
+        rules kept in the "ip nat pia_portforward" chain.
+      '';
+      type = types.nullOr types.str;
+      default = null;
+      example = "192.168.100.100";
+    };
+
+    portForwardInterval = mkOption {
+      description = "How often the port forwarding daemon refreshes the port binding (only relevant if portForwardDaemon is enabled).";
+      type = types.str;
+      default = "15m";
+    };
+
     netdevTemplateFile = mkOption {
       description = "systemd.netdev file containing template parameters with which to generate the actual netdev.";
       type = types.path;
@@ -267,7 +395,7 @@ in
             netdev = cfg.cacheDir + "/" + builtins.baseNameOf cfg.netdevFile;
             network = cfg.cacheDir + "/" + builtins.baseNameOf cfg.networkFile;
           in
-          ''${cfg.package}/bin/pia-setup-tunnel --wg-binary ${pkgs.wireguard-tools}/bin/wg --cache-dir ${cfg.cacheDir} --region ${cfg.region} --if-name ${cfg.ifname} --netdev-file="template=${cfg.netdevTemplateFile},output=${netdev},mode=0440" --network-file="template=${cfg.networkTemplateFile},output=${network},mode=0444"'';
+          ''${cfg.package}/bin/pia-setup-tunnel --wg-binary ${pkgs.wireguard-tools}/bin/wg --cache-dir ${cfg.cacheDir} --region ${cfg.region} --probe ${cfg.probe} --if-name ${cfg.ifname} --netdev-file="template=${cfg.netdevTemplateFile},output=${netdev},mode=0440" --network-file="template=${cfg.networkTemplateFile},output=${network},mode=0444"${killSwitchArgs}'';
         ExecStartPost = [
           ''+${cfg.package}/bin/pia-setup-tunnel --from-cache --cache-dir ${cfg.cacheDir} --if-name ${cfg.ifname} --netdev-file="template=${cfg.netdevTemplateFile},output=${cfg.netdevFile},group=systemd-network,mode=0440" --network-file="template=${cfg.networkTemplateFile},output=${cfg.networkFile},mode=0444"''
           "-${pkgs.iproute2}/bin/ip link set down dev ${cfg.ifname}"
@@ -280,8 +408,17 @@ in
           ''${pkgs.bash}/bin/bash -c '${cfg.whitelistScript} "$(${getIp})"' ''
         ]
         ++ lib.optionals (cfg.portForwarding) [
-          "${pkgs.coreutils}/bin/sleep 10"
-          "-${cfg.package}/bin/pia-portforward --cache-dir ${cfg.cacheDir} --if-name ${cfg.ifname}"
+          # wait for the new tunnel to come up
+          "-+${cfg.package}/bin/pia-healthcheck --privileged --cache-dir ${cfg.cacheDir} --if-name ${cfg.ifname}"
+        ]
+        ++ lib.optionals (cfg.portForwarding && !cfg.portForwardDaemon) [
+          "-${cfg.package}/bin/pia-portforward ${portForwardArgs}"
+        ]
+        # the daemon must not race a one-shot run for the signature and the
+        # cache; restart it instead, so that it binds a port on the new tunnel
+        # without waiting for its next refresh
+        ++ lib.optionals (cfg.portForwarding && cfg.portForwardDaemon) [
+          "+${pkgs.systemd}/bin/systemctl --no-block try-restart ${cfg.refreshServiceName}.service"
         ];
       };
     };
@@ -293,26 +430,75 @@ in
       wantedBy = [ "timers.target" ];
     };
 
+    # Tunnel health check, resetting the tunnel when it fails
+    systemd.services.${cfg.healthCheckServiceName} = lib.mkIf cfg.healthCheck {
+      description = "Check the health of the ${cfg.ifname} VPN tunnel";
+      name = "${cfg.healthCheckServiceName}.service";
+      after = [ "${cfg.resetServiceName}.service" ];
+      # (re)started along with the tunnel, and resets it in turn once it has
+      # failed for long enough, or hung
+      wantedBy = [
+        "multi-user.target"
+        "${cfg.resetServiceName}.service"
+      ];
+      unitConfig.OnFailure = [ "${cfg.resetServiceName}.service" ];
+      serviceConfig = {
+        User = cfg.user;
+        Type = "notify";
+        ExecStart = "${cfg.package}/bin/pia-healthcheck --watch --privileged --interval 30s --cache-dir ${cfg.cacheDir} --if-name ${cfg.ifname}";
+        WatchdogSec = "5m";
+        CapabilityBoundingSet = [
+          "CAP_NET_ADMIN"
+          "CAP_NET_RAW"
+        ];
+        AmbientCapabilities = [
+          "CAP_NET_ADMIN"
+          "CAP_NET_RAW"
+        ];
+        NoNewPrivileges = true;
+        ProtectSystem = "strict";
+        ProtectHome = true;
+        PrivateTmp = true;
+      };
+    };
+
     # Port forwarding refresh service and timer
     systemd.services.${cfg.refreshServiceName} = lib.mkIf (cfg.portForwarding) {
       description = "Refresh port forwarding assignment for the ${cfg.ifname} VPN tunnel";
       name = "${cfg.refreshServiceName}.service";
       path = [ pkgs.wireguard-tools ];
+      after = lib.optionals cfg.portForwardDaemon [ "${cfg.resetServiceName}.service" ];
+      wantedBy = lib.optionals cfg.portForwardDaemon [ "multi-user.target" ];
       serviceConfig = {
         User = cfg.user;
-        Type = "oneshot";
         EnvironmentFile = [
           serviceEnvFile
           cfg.envFile
         ];
-        ExecStart = "${cfg.package}/bin/pia-portforward --cache-dir ${cfg.cacheDir} --if-name ${cfg.ifname} --refresh";
+      }
+      // (
+        if cfg.portForwardDaemon then
+          {
+            Type = "notify";
+            ExecStart = "${cfg.package}/bin/pia-portforward ${portForwardArgs} daemon --interval ${cfg.portForwardInterval}";
+            Restart = "on-failure";
+            WatchdogSec = "5m";
+          }
+        else
+          {
+            Type = "oneshot";
+            ExecStart = "${cfg.package}/bin/pia-portforward ${portForwardArgs} --refresh";
+          }
+      )
+      // lib.attrsets.optionalAttrs (cfg.nftSet != null || cfg.nftDnat != null) {
+        AmbientCapabilities = [ "CAP_NET_ADMIN" ];
       }
       // lib.attrsets.optionalAttrs (cfg.whitelistScript != null) {
         ExecStartPost = ''+${pkgs.bash}/bin/bash -c '${cfg.whitelistScript} "$(${getIp})"' '';
       };
     };
     systemd.timers.${cfg.refreshServiceName} =
-      lib.mkIf (cfg.portForwarding && cfg.refreshTimerConfig != null)
+      lib.mkIf (cfg.portForwarding && !cfg.portForwardDaemon && cfg.refreshTimerConfig != null)
         {
           description = "Refresh port forwarding assignment for the ${cfg.ifname} VPN tunnel";
           name = "${cfg.refreshServiceName}.timer";
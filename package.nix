@@ -4,7 +4,7 @@ pkgs.buildGoModule {
   pname = "pia-tools";
   version = "2.0.2";
   src = ./.;
-  vendorHash = "sha256-CwNP6jQuDUPK8lHGEQIHlSzcmmT6KhbUhY3iYsO/eVI=";
+  vendorHash = "sha256-kQw5L5Gkjmr+POuIG5r+qx/NgIziY8a6/m9C7uLdhbI=";
   env.CGO_ENABLED = 0;
   meta = {
     description = "Toolset to manage wireguard tunnels to privateinternetaccess.com";